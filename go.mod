@@ -3,17 +3,20 @@ module medical-card
 go 1.19
 
 require (
-	github.com/caarlos0/env/v7 v7.1.0 // indirect
+	github.com/caarlos0/env/v7 v7.1.0
+	github.com/google/uuid v1.3.0
+	github.com/gorilla/mux v1.8.0
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.7
+	github.com/stretchr/testify v1.8.2
+	golang.org/x/crypto v0.7.0
+)
+
+require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/uuid v1.3.0 // indirect
-	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/securecookie v1.1.1 // indirect
 	github.com/gorilla/sessions v1.2.1 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/lib/pq v1.10.7 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.2 // indirect
-	golang.org/x/crypto v0.7.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"log"
+
+	"medical-card/internal/entity"
+)
+
+type ctxKey int
+
+const (
+	sessionCtxKey ctxKey = iota
+	patientCtxKey
+	doctorCtxKey
+	apiKeyCtxKey
+	requestIDCtxKey
+)
+
+func WithSession(ctx context.Context, sess entity.Session) context.Context {
+	return context.WithValue(ctx, sessionCtxKey, sess)
+}
+
+func SessionFromContext(ctx context.Context) (entity.Session, bool) {
+	sess, ok := ctx.Value(sessionCtxKey).(entity.Session)
+	return sess, ok
+}
+
+func WithPatient(ctx context.Context, p entity.Patient) context.Context {
+	return context.WithValue(ctx, patientCtxKey, p)
+}
+
+func PatientFromContext(ctx context.Context) (entity.Patient, bool) {
+	p, ok := ctx.Value(patientCtxKey).(entity.Patient)
+	return p, ok
+}
+
+func WithDoctor(ctx context.Context, d entity.Doctor) context.Context {
+	return context.WithValue(ctx, doctorCtxKey, d)
+}
+
+func DoctorFromContext(ctx context.Context) (entity.Doctor, bool) {
+	d, ok := ctx.Value(doctorCtxKey).(entity.Doctor)
+	return d, ok
+}
+
+func WithAPIKey(ctx context.Context, k entity.APIKey) context.Context {
+	return context.WithValue(ctx, apiKeyCtxKey, k)
+}
+
+func APIKeyFromContext(ctx context.Context) (entity.APIKey, bool) {
+	k, ok := ctx.Value(apiKeyCtxKey).(entity.APIKey)
+	return k, ok
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey, id)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey).(string)
+	return id
+}
+
+func audit(ctx context.Context, format string, args ...any) {
+	sess, ok := SessionFromContext(ctx)
+	if !ok {
+		log.Printf("audit: anonymous: "+format, args...)
+		return
+	}
+
+	log.Printf("audit: %s %d: "+format, append([]any{sess.Role, sess.UserID}, args...)...)
+}
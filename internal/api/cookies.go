@@ -0,0 +1,182 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"medical-card/internal/app"
+	"medical-card/internal/entity"
+	"medical-card/internal/service"
+)
+
+const (
+	sessionCookieName = "ssid"
+	csrfCookieName    = "csrf_token"
+	csrfHeaderName    = "X-CSRF-Token"
+	csrfTokenSize     = 32
+
+	oidcStateCookieName = "oidc_state"
+)
+
+// Cookies issues the session cookie and the CSRF cookie paired with it,
+// using the attributes from the configuration.
+type Cookies struct {
+	c        app.CookieConfig
+	sameSite http.SameSite
+}
+
+func NewCookies(c app.CookieConfig) (*Cookies, error) {
+	var sameSite http.SameSite
+
+	switch strings.ToLower(c.SameSite) {
+	case "", "lax":
+		sameSite = http.SameSiteLaxMode
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		if !c.Secure {
+			return nil, fmt.Errorf("cookie SameSite=None requires Secure")
+		}
+		sameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown cookie SameSite mode %q", c.SameSite)
+	}
+
+	if c.Path == "" {
+		c.Path = "/"
+	}
+
+	return &Cookies{c: c, sameSite: sameSite}, nil
+}
+
+// SetSession (re)sends the session cookie, e.g. after its expiry moved.
+func (c *Cookies) SetSession(w http.ResponseWriter, sess entity.Session) {
+	cookie := c.cookie(sessionCookieName, sess.ID.String(), true)
+	cookie.Expires = sess.ExpiredAt
+
+	http.SetCookie(w, cookie)
+}
+
+// StartSession sends the cookie of a new session together with a fresh CSRF
+// token.
+func (c *Cookies) StartSession(w http.ResponseWriter, sess entity.Session) error {
+	c.SetSession(w, sess)
+
+	return c.issueCSRF(w)
+}
+
+func (c *Cookies) ClearSession(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookieName, csrfCookieName} {
+		cookie := c.cookie(name, "", name == sessionCookieName)
+		cookie.MaxAge = -1
+
+		http.SetCookie(w, cookie)
+	}
+}
+
+// SetOIDCState binds a single sign-on login to the browser that started it.
+// The cookie is always SameSite=Lax, since the identity provider sends the
+// browser back with a cross-site navigation.
+func (c *Cookies) SetOIDCState(w http.ResponseWriter, state string) {
+	cookie := c.cookie(oidcStateCookieName, state, true)
+	cookie.SameSite = http.SameSiteLaxMode
+
+	http.SetCookie(w, cookie)
+}
+
+// CheckOIDCState tells whether state is the one bound to this browser.
+func (c *Cookies) CheckOIDCState(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) == 1
+}
+
+func (c *Cookies) ClearOIDCState(w http.ResponseWriter) {
+	cookie := c.cookie(oidcStateCookieName, "", true)
+	cookie.SameSite = http.SameSiteLaxMode
+	cookie.MaxAge = -1
+
+	http.SetCookie(w, cookie)
+}
+
+// CSRF implements the double-submit cookie pattern: a state-changing request
+// riding on the session cookie must echo the CSRF cookie in X-CSRF-Token,
+// which a cross-site page cannot read. Requests authenticated by a header
+// instead of the cookie carry no ambient credentials and are exempt.
+func (c *Cookies) CSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if usesHeaderAuth(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if _, err := r.Cookie(sessionCookieName); err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(csrfCookieName)
+		header := r.Header.Get(csrfHeaderName)
+		if err != nil || header == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(header)) != 1 {
+			SendErr(w, r, fmt.Errorf("%w: missing or invalid CSRF token", service.ErrForbidden))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ensureCSRF hands a CSRF token to sessions that do not have one yet, e.g.
+// after the browser dropped the CSRF cookie at restart.
+func (c *Cookies) ensureCSRF(w http.ResponseWriter, r *http.Request) error {
+	if _, err := r.Cookie(csrfCookieName); err == nil {
+		return nil
+	}
+
+	return c.issueCSRF(w)
+}
+
+func (c *Cookies) issueCSRF(w http.ResponseWriter) error {
+	raw := make([]byte, csrfTokenSize)
+
+	_, err := rand.Read(raw)
+	if err != nil {
+		return fmt.Errorf("generate CSRF token: %w", err)
+	}
+
+	// Scripts must be able to read this one to echo it back, so it is not
+	// HttpOnly, and it lives as long as the browser session.
+	http.SetCookie(w, c.cookie(csrfCookieName, base64.RawURLEncoding.EncodeToString(raw), false))
+
+	return nil
+}
+
+func (c *Cookies) cookie(name, value string, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     c.c.Path,
+		Domain:   c.c.Domain,
+		Secure:   c.c.Secure,
+		HttpOnly: httpOnly,
+		SameSite: c.sameSite,
+	}
+}
+
+func usesHeaderAuth(r *http.Request) bool {
+	_, ok := bearerToken(r)
+	return ok || r.Header.Get("X-API-Key") != ""
+}
@@ -1,29 +1,257 @@
 package api
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"medical-card/internal/service"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+	maxPatchSize     = 1 << 20
 )
 
-type ResponseError struct {
-	Error string `json:"error"`
+// Problem is an RFC 7807 problem details document.
+type Problem struct {
+	Type          string               `json:"type"`
+	Title         string               `json:"title"`
+	Status        int                  `json:"status"`
+	Detail        string               `json:"detail,omitempty"`
+	Instance      string               `json:"instance,omitempty"`
+	Errors        []service.FieldError `json:"errors,omitempty"`
+	CorrelationID string               `json:"correlation_id,omitempty"`
 }
 
-func SendErr(w http.ResponseWriter, code int, err error) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	err = json.NewEncoder(w).Encode(ResponseError{Error: err.Error()})
+type Page struct {
+	Items  any `json:"items"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
+// problemTypes ties every service sentinel to the status it is reported
+// with and a fixed detail for the client. The sentinel's message doubles as
+// the problem title and type slug.
+var problemTypes = []struct {
+	err    error
+	status int
+	detail string
+}{
+	{service.ErrInvalid, http.StatusBadRequest, "The request is malformed or has invalid values."},
+	{service.ErrUnauthorized, http.StatusUnauthorized, "Valid credentials are required."},
+	{service.ErrForbidden, http.StatusForbidden, "You are not allowed to do this."},
+	{service.ErrNotFound, http.StatusNotFound, "The resource does not exist."},
+	{service.ErrAlreadyExists, http.StatusConflict, "A resource with the same unique values already exists."},
+	{service.ErrConflict, http.StatusConflict, "The request conflicts with the current state of the resource."},
+	{service.ErrVersionConflict, http.StatusPreconditionFailed, "The resource was changed since it was read; fetch it again."},
+	{service.ErrPreconditionRequired, http.StatusPreconditionRequired, "Send If-Match with the ETag of the resource."},
+	{service.ErrTooManyAttempts, http.StatusTooManyRequests, "Too many attempts; retry later."},
+}
+
+// SendErr is the single place where service errors become HTTP responses.
+// The client gets the fixed detail of the matching sentinel and, for
+// validation errors, the field messages, but never the error text: it may
+// carry ids, column names and driver details. Anything SendErr does not
+// recognise is logged and reported as an opaque internal error.
+func SendErr(w http.ResponseWriter, r *http.Request, err error) {
+	sentinel, status, detail := service.ErrInternal, http.StatusInternalServerError, ""
+	for _, pt := range problemTypes {
+		if errors.Is(err, pt.err) {
+			sentinel, status, detail = pt.err, pt.status, pt.detail
+			break
+		}
+	}
+
+	p := Problem{
+		Type:          problemType(sentinel),
+		Title:         problemTitle(sentinel),
+		Status:        status,
+		Detail:        detail,
+		Instance:      r.URL.RequestURI(),
+		CorrelationID: RequestIDFromContext(r.Context()),
+	}
+
+	var verr *service.ValidationError
+	if errors.As(err, &verr) {
+		p.Status = http.StatusUnprocessableEntity
+		p.Detail = "Some fields are invalid; see errors."
+		p.Errors = verr.Fields
+	}
+
+	var lerr *service.LockoutError
+	if errors.As(err, &lerr) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lerr.RetryAfter.Seconds()))))
+	}
+
+	if status == http.StatusInternalServerError {
+		log.Printf("request %s: %s %s: %v", p.CorrelationID, r.Method, r.URL.Path, err)
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	err = json.NewEncoder(w).Encode(p)
 	if err != nil {
 		log.Println(err)
 	}
 }
 
+func problemType(sentinel error) string {
+	return "/problems/" + strings.ReplaceAll(sentinel.Error(), " ", "-")
+}
+
+func problemTitle(sentinel error) string {
+	msg := sentinel.Error()
+	return strings.ToUpper(msg[:1]) + msg[1:]
+}
+
 func SendJSON(w http.ResponseWriter, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(data)
 	if err != nil {
-		SendErr(w, http.StatusInternalServerError, err)
-		return
+		log.Println(err)
+	}
+}
+
+func decodeJSON(r *http.Request, v any) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		return fmt.Errorf("%w: malformed body: %v", service.ErrInvalid, err)
+	}
+
+	return nil
+}
+
+// readMergePatch returns the raw RFC 7396 merge patch sent with a PATCH
+// request. Plain application/json is accepted as well for clients that
+// cannot set a custom media type.
+func readMergePatch(r *http.Request) ([]byte, error) {
+	ct, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (ct != "application/merge-patch+json" && ct != "application/json") {
+		return nil, fmt.Errorf("%w: expected application/merge-patch+json body", service.ErrInvalid)
+	}
+
+	patch, err := io.ReadAll(io.LimitReader(r.Body, maxPatchSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: read body: %v", service.ErrInvalid, err)
+	}
+
+	if len(patch) > maxPatchSize {
+		return nil, fmt.Errorf("%w: patch exceeds %d bytes", service.ErrInvalid, maxPatchSize)
+	}
+
+	if !json.Valid(patch) {
+		return nil, fmt.Errorf("%w: malformed merge patch", service.ErrInvalid)
+	}
+
+	return patch, nil
+}
+
+// setETag exposes a row version as a strong entity tag so that clients can
+// send it back in If-Match.
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// ifMatch returns the version a write is conditioned on. Writes must name
+// the version they were based on, so a missing header and "*" are refused.
+func ifMatch(r *http.Request) (int64, error) {
+	tag := strings.TrimSpace(r.Header.Get("If-Match"))
+	if tag == "" || tag == "*" {
+		return 0, fmt.Errorf("%w: send the ETag of the resource in If-Match", service.ErrPreconditionRequired)
+	}
+
+	// Weak tags and tags we never issued cannot match the current version.
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, fmt.Errorf("entity tag %s: %w", tag, service.ErrVersionConflict)
+	}
+
+	version, err := strconv.ParseInt(unquoted, 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("entity tag %s: %w", tag, service.ErrVersionConflict)
+	}
+
+	return version, nil
+}
+
+// clientIP is the address login attempts are throttled by.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func pathID(r *http.Request, name string) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s must be an integer", service.ErrInvalid, name)
+	}
+
+	return id, nil
+}
+
+type CursorPage struct {
+	Items      any    `json:"items"`
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+func encodeCursor(cursor any) (string, error) {
+	b, err := json.Marshal(cursor)
+	if err != nil {
+		return "", err
 	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func decodeCursor(s string, cursor any) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("%w: malformed cursor", service.ErrInvalid)
+	}
+
+	err = json.Unmarshal(b, cursor)
+	if err != nil {
+		return fmt.Errorf("%w: malformed cursor", service.ErrInvalid)
+	}
+
+	return nil
+}
+
+func limitOffset(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageLimit
+
+	q := r.URL.Query()
+
+	if v := q.Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, fmt.Errorf("%w: limit must be between 1 and %d", service.ErrInvalid, maxPageLimit)
+		}
+	}
+
+	if v := q.Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("%w: offset must be a non-negative integer", service.ErrInvalid)
+		}
+	}
+
+	return limit, offset, nil
 }
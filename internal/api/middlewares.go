@@ -1,35 +1,266 @@
 package api
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"strings"
 
+	"medical-card/internal/entity"
 	"medical-card/internal/service"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 )
 
+const maxRequestIDLength = 128
+
+// RequestID tags every request with an id, reusing the caller's X-Request-ID
+// when it sends a sane one, so that error responses can be matched with logs.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
 type AuthMiddleware struct {
-	srv Service
+	srv     Service
+	cookies *Cookies
 }
 
-func NewAuthMiddleware(srv Service) *AuthMiddleware {
+func NewAuthMiddleware(srv Service, cookies *Cookies) *AuthMiddleware {
 	return &AuthMiddleware{
-		srv: srv,
+		srv:     srv,
+		cookies: cookies,
 	}
 }
 
+// Require authenticates the request by an API key or a bearer access token
+// if it carries one and by the session cookie otherwise. Tokens and cookies
+// resolve to a user session; API keys to a service session holding the key.
+// Sessions still waiting for a second factor are rejected.
 func (a *AuthMiddleware) Require(next http.Handler) http.Handler {
+	return a.require(next, false)
+}
+
+// RequirePending accepts only cookie sessions waiting for a second factor.
+func (a *AuthMiddleware) RequirePending(next http.Handler) http.Handler {
+	return a.require(next, true)
+}
+
+func (a *AuthMiddleware) require(next http.Handler, pending bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("ssid")
+		if pending && usesHeaderAuth(r) {
+			SendErr(w, r, service.ErrUnauthorized)
+			return
+		}
+
+		if key := r.Header.Get("X-API-Key"); key != "" {
+			a.requireAPIKey(w, r, key, next)
+			return
+		}
+
+		if token, ok := bearerToken(r); ok {
+			a.requireBearer(w, r, token, next)
+			return
+		}
+
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil {
+			SendErr(w, r, service.ErrUnauthorized)
+			return
+		}
+
+		sess, err := a.srv.SessionByID(r.Context(), cookie.Value)
+		if err != nil || (sess.MFA == entity.MFAPending) != pending {
+			SendErr(w, r, service.ErrUnauthorized)
+			return
+		}
+
+		sess, renewed, err := a.srv.RenewSession(r.Context(), sess)
+		if err != nil {
+			SendErr(w, r, err)
+			return
+		}
+
+		if renewed {
+			a.cookies.SetSession(w, sess)
+		}
+
+		err = a.cookies.ensureCSRF(w, r)
+		if err != nil {
+			SendErr(w, r, err)
+			return
+		}
+
+		ctx, err := a.withPrincipal(r.Context(), sess)
 		if err != nil {
-			SendErr(w, http.StatusUnauthorized, service.ErrUnauthorized)
+			SendErr(w, r, service.ErrUnauthorized)
+			return
+		}
+
+		// Only requests authenticated by the cookie need CSRF protection, so
+		// public endpoints such as login keep working with a stale cookie.
+		a.cookies.CSRF(next).ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (a *AuthMiddleware) requireBearer(w http.ResponseWriter, r *http.Request, token string, next http.Handler) {
+	sess, err := a.srv.SessionByAccessToken(r.Context(), token)
+	if err != nil || sess.MFA == entity.MFAPending {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	ctx, err := a.withPrincipal(r.Context(), sess)
+	if err != nil {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (a *AuthMiddleware) requireAPIKey(w http.ResponseWriter, r *http.Request, key string, next http.Handler) {
+	k, err := a.srv.APIKeyByKey(r.Context(), key)
+	if err != nil {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	sess := entity.Session{
+		UserID:    k.ID,
+		Role:      entity.RoleService,
+		CreatedAt: k.CreatedAt,
+	}
+
+	ctx := WithAPIKey(WithSession(r.Context(), sess), k)
+
+	next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return "", false
+	}
+
+	token := strings.TrimPrefix(auth, "Bearer ")
+	return token, token != ""
+}
+
+// RequireRole must be used after Require.
+func (a *AuthMiddleware) RequireRole(roles ...entity.Role) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sess, ok := SessionFromContext(r.Context())
+			if !ok {
+				SendErr(w, r, service.ErrUnauthorized)
+				return
+			}
+
+			if !sess.HasRole(roles...) {
+				SendErr(w, r, service.ErrForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRoleOrScope lets through users with one of roles and API keys
+// granted scope. It must be used after Require.
+func (a *AuthMiddleware) RequireRoleOrScope(scope string, roles ...entity.Role) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sess, ok := SessionFromContext(r.Context())
+			if !ok {
+				SendErr(w, r, service.ErrUnauthorized)
+				return
+			}
+
+			if !sess.HasRole(roles...) && !hasScope(r.Context(), scope) {
+				SendErr(w, r, service.ErrForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func hasScope(ctx context.Context, scope string) bool {
+	k, ok := APIKeyFromContext(ctx)
+	return ok && k.HasScope(scope)
+}
+
+// RequireAdmin lets through doctors with administrative rights only. It must
+// be used after Require.
+func (a *AuthMiddleware) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := SessionFromContext(r.Context()); !ok {
+			SendErr(w, r, service.ErrUnauthorized)
+			return
+		}
+
+		d, ok := DoctorFromContext(r.Context())
+		if !ok || !d.IsAdmin {
+			SendErr(w, r, service.ErrForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireMFAPolicy rejects sessions that the two-factor policy keeps away
+// from patient records and medical cards. It must be used after Require.
+func (a *AuthMiddleware) RequireMFAPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, ok := SessionFromContext(r.Context())
+		if !ok {
+			SendErr(w, r, service.ErrUnauthorized)
 			return
 		}
 
-		_, err = a.srv.PatientBySessionID(r.Context(), cookie.Value)
+		err := a.srv.CheckMFAPolicy(sess)
 		if err != nil {
-			SendErr(w, http.StatusUnauthorized, service.ErrUnauthorized)
+			SendErr(w, r, err)
 			return
 		}
 
 		next.ServeHTTP(w, r)
 	})
 }
+
+func (a *AuthMiddleware) withPrincipal(ctx context.Context, sess entity.Session) (context.Context, error) {
+	ctx = WithSession(ctx, sess)
+
+	switch sess.Role {
+	case entity.RolePatient:
+		p, err := a.srv.PatientByID(ctx, sess.UserID)
+		if err != nil {
+			return ctx, err
+		}
+
+		return WithPatient(ctx, p), nil
+	case entity.RoleDoctor:
+		d, err := a.srv.DoctorByID(ctx, sess.UserID)
+		if err != nil {
+			return ctx, err
+		}
+
+		return WithDoctor(ctx, d), nil
+	default:
+		return ctx, fmt.Errorf("unknown role %q", sess.Role)
+	}
+}
@@ -2,8 +2,6 @@ package api
 
 import (
 	"context"
-	"encoding/json"
-	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -16,25 +14,73 @@ import (
 
 type Service interface {
 	AddPatient(ctx context.Context, p entity.Patient) (entity.Patient, error)
-	Patients(ctx context.Context) ([]entity.Patient, error)
+	Patients(ctx context.Context, q entity.PatientQuery) ([]entity.Patient, *entity.PatientCursor, error)
+	SearchPatients(ctx context.Context, query string, limit int) ([]entity.PatientSearchResult, error)
 	PatientByPassportNumber(ctx context.Context, passNumber string) (entity.Patient, error)
+	PatientByID(ctx context.Context, id int64) (entity.Patient, error)
 	PatientByLogin(ctx context.Context, login string) (entity.Patient, error)
-	UpdatePatient(ctx context.Context, id int64, p entity.Patient) error
-	DeletePatient(ctx context.Context, id int64) error
+	UpdatePatient(ctx context.Context, id int64, p entity.Patient) (entity.Patient, error)
+	PatchPatient(ctx context.Context, id, version int64, patch []byte) (entity.Patient, error)
+	DeletePatient(ctx context.Context, id, version int64) error
 
 	AddCard(ctx context.Context, c entity.Card) (entity.Card, error)
-	UpdateCard(ctx context.Context, id int64, c entity.Card) error
+	CardByID(ctx context.Context, id int64) (entity.Card, error)
+	CardByPatientID(ctx context.Context, patientID int64) (entity.Card, error)
+	Cards(ctx context.Context, f entity.CardFilter, limit, offset int) ([]entity.Card, error)
+	UpdateCard(ctx context.Context, id int64, c entity.Card) (entity.Card, error)
+	PatchCard(ctx context.Context, id, version int64, patch []byte) (entity.Card, error)
+	DeleteCard(ctx context.Context, id, version int64) error
 
-	Login(ctx context.Context, patientID int64) (entity.Session, error)
-	PatientBySessionID(ctx context.Context, ssid string) (entity.Patient, error)
+	AddConsultation(ctx context.Context, c entity.Consultation) (entity.Consultation, error)
+	CardConsultations(ctx context.Context, cardID int64, limit, offset int) ([]entity.Consultation, error)
+	UpdateConsultation(ctx context.Context, cardID, id int64, c entity.Consultation) (entity.Consultation, error)
+
+	AddDoctor(ctx context.Context, d entity.Doctor) (entity.Doctor, error)
+	DoctorByID(ctx context.Context, id int64) (entity.Doctor, error)
+
+	Login(ctx context.Context, creds entity.Credentials, ip string) (entity.Session, error)
+	Signup(ctx context.Context, p entity.Patient) (entity.Patient, entity.Session, error)
+	SessionByID(ctx context.Context, ssid string) (entity.Session, error)
+	RenewSession(ctx context.Context, sess entity.Session) (entity.Session, bool, error)
+	RefreshSession(ctx context.Context, sess entity.Session) (entity.Session, error)
+	Logout(ctx context.Context, current entity.Session, ssid string) error
+	LogoutAll(ctx context.Context, current entity.Session) error
+
+	IssueTokens(ctx context.Context, creds entity.Credentials, ip string) (entity.TokenPair, error)
+	RefreshTokens(ctx context.Context, refreshToken string) (entity.TokenPair, error)
+	SessionByAccessToken(ctx context.Context, token string) (entity.Session, error)
+
+	ChangePassword(ctx context.Context, sess entity.Session, ch entity.PasswordChange) (entity.Session, error)
+	ChangePasswordTokens(ctx context.Context, sess entity.Session, ch entity.PasswordChange) (entity.TokenPair, error)
+	RequestPasswordReset(ctx context.Context, req entity.PasswordResetRequest) error
+	ResetPassword(ctx context.Context, token, password string) error
+	UnlockAccount(ctx context.Context, req entity.UnlockRequest) error
+
+	CreateAPIKey(ctx context.Context, k entity.APIKey, createdBy int64) (entity.APIKey, error)
+	APIKeys(ctx context.Context) ([]entity.APIKey, error)
+	RotateAPIKey(ctx context.Context, id int64) (entity.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int64) error
+	APIKeyByKey(ctx context.Context, key string) (entity.APIKey, error)
+
+	EnrollTOTP(ctx context.Context, sess entity.Session) (entity.TOTPEnrollment, error)
+	ConfirmTOTP(ctx context.Context, sess entity.Session, code string) error
+	DisableTOTP(ctx context.Context, sess entity.Session, code string) error
+	RegenerateRecoveryCodes(ctx context.Context, sess entity.Session, code string) ([]string, error)
+	VerifySecondFactor(ctx context.Context, sess entity.Session, code, ip string) (entity.Session, error)
+	ResetTOTP(ctx context.Context, req entity.UnlockRequest) error
+	CheckMFAPolicy(sess entity.Session) error
+
+	StartOIDCLogin(ctx context.Context, returnTo string) (string, string, error)
+	FinishOIDCLogin(ctx context.Context, state, code string) (entity.Session, string, error)
 }
 
 type PatientHandler struct {
-	srv Service
+	srv     Service
+	cookies *Cookies
 }
 
-func NewPatientHandler(srv Service) *PatientHandler {
-	return &PatientHandler{srv: srv}
+func NewPatientHandler(srv Service, cookies *Cookies) *PatientHandler {
+	return &PatientHandler{srv: srv, cookies: cookies}
 }
 
 // Patient methods
@@ -42,20 +88,15 @@ func NewPatientHandler(srv Service) *PatientHandler {
 func (h *PatientHandler) AddPatient(w http.ResponseWriter, r *http.Request) {
 	var patient entity.Patient
 
-	err := json.NewDecoder(r.Body).Decode(&patient)
+	err := decodeJSON(r, &patient)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
 	patient, err = h.srv.AddPatient(r.Context(), patient)
 	if err != nil {
-		if errors.Is(err, service.ErrAlreadyExists) {
-			SendErr(w, http.StatusConflict, err)
-			return
-		}
-
-		SendErr(w, http.StatusInternalServerError, err)
+		SendErr(w, r, err)
 		return
 	}
 
@@ -65,13 +106,45 @@ func (h *PatientHandler) AddPatient(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *PatientHandler) Patients(w http.ResponseWriter, r *http.Request) {
-	patients, err := h.srv.Patients(r.Context())
+	q, err := patientQuery(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	patients, next, err := h.srv.Patients(r.Context(), q)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	page := CursorPage{Items: patients}
+
+	if next != nil {
+		page.NextCursor, err = encodeCursor(next)
+		if err != nil {
+			SendErr(w, r, err)
+			return
+		}
+	}
+
+	SendJSON(w, page)
+}
+
+func (h *PatientHandler) SearchPatients(w http.ResponseWriter, r *http.Request) {
+	limit, _, err := limitOffset(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	results, err := h.srv.SearchPatients(r.Context(), r.URL.Query().Get("q"), limit)
 	if err != nil {
-		SendErr(w, http.StatusInternalServerError, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	SendJSON(w, patients)
+	SendJSON(w, CursorPage{Items: results})
 }
 
 func (h *PatientHandler) PatientByPassportNumber(w http.ResponseWriter, r *http.Request) {
@@ -79,50 +152,109 @@ func (h *PatientHandler) PatientByPassportNumber(w http.ResponseWriter, r *http.
 
 	patient, err := h.srv.PatientByPassportNumber(r.Context(), passNumber)
 	if err != nil {
-		SendErr(w, http.StatusInsufficientStorage, err)
+		SendErr(w, r, err)
 		return
 	}
 
+	setETag(w, patient.Version)
 	SendJSON(w, patient)
 }
 
 func (h *PatientHandler) UpdatePatient(w http.ResponseWriter, r *http.Request) {
 	var patient entity.Patient
 
-	err := json.NewDecoder(r.Body).Decode(&patient)
+	err := decodeJSON(r, &patient)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if !canAccessPatient(r.Context(), id, entity.ScopePatientsWrite) {
+		SendErr(w, r, service.ErrForbidden)
+		return
+	}
+
+	patient.Version, err = ifMatch(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	patient, err = h.srv.UpdatePatient(r.Context(), id, patient)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "updated patient %d", id)
+
+	setETag(w, patient.Version)
+	SendJSON(w, patient)
+}
+
+func (h *PatientHandler) PatchPatient(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if !canAccessPatient(r.Context(), id, entity.ScopePatientsWrite) {
+		SendErr(w, r, service.ErrForbidden)
+		return
+	}
+
+	version, err := ifMatch(r)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	patch, err := readMergePatch(r)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	err = h.srv.UpdatePatient(r.Context(), int64(id), patient)
+	patient, err := h.srv.PatchPatient(r.Context(), id, version, patch)
 	if err != nil {
-		SendErr(w, http.StatusInsufficientStorage, err)
+		SendErr(w, r, err)
 		return
 	}
 
+	audit(r.Context(), "patched patient %d", id)
+
+	setETag(w, patient.Version)
 	SendJSON(w, patient)
 }
 
 func (h *PatientHandler) DeletePatient(w http.ResponseWriter, r *http.Request) {
-	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	version, err := ifMatch(r)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	err = h.srv.DeletePatient(r.Context(), int64(id))
+	err = h.srv.DeletePatient(r.Context(), id, version)
 	if err != nil {
-		SendErr(w, http.StatusInsufficientStorage, err)
+		SendErr(w, r, err)
 		return
 	}
 
+	audit(r.Context(), "deleted patient %d", id)
+
 	SendJSON(w, id)
 }
 
@@ -131,20 +263,15 @@ func (h *PatientHandler) DeletePatient(w http.ResponseWriter, r *http.Request) {
 func (h *PatientHandler) AddCard(w http.ResponseWriter, r *http.Request) {
 	var card entity.Card
 
-	err := json.NewDecoder(r.Body).Decode(&card)
+	err := decodeJSON(r, &card)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
 	card, err = h.srv.AddCard(r.Context(), card)
 	if err != nil {
-		if errors.Is(err, service.ErrAlreadyExists) {
-			SendErr(w, http.StatusConflict, err)
-			return
-		}
-
-		SendErr(w, http.StatusInternalServerError, err)
+		SendErr(w, r, err)
 		return
 	}
 
@@ -154,60 +281,957 @@ func (h *PatientHandler) AddCard(w http.ResponseWriter, r *http.Request) {
 func (h *PatientHandler) UpdateCard(w http.ResponseWriter, r *http.Request) {
 	var card entity.Card
 
-	err := json.NewDecoder(r.Body).Decode(&card)
+	err := decodeJSON(r, &card)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	card.Version, err = ifMatch(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	card, err = h.srv.UpdateCard(r.Context(), id, card)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "updated card %d of patient %d", id, card.PatientID)
+
+	setETag(w, card.Version)
+	SendJSON(w, card)
+}
+
+func (h *PatientHandler) PatchCard(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	version, err := ifMatch(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	patch, err := readMergePatch(r)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	card, err := h.srv.PatchCard(r.Context(), id, version, patch)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	err = h.srv.UpdateCard(r.Context(), int64(id), card)
+	audit(r.Context(), "patched card %d of patient %d", id, card.PatientID)
+
+	setETag(w, card.Version)
+	SendJSON(w, card)
+}
+
+func (h *PatientHandler) CardByID(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	card, err := h.srv.CardByID(r.Context(), id)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if !canAccessPatient(r.Context(), card.PatientID, entity.ScopeCardsRead) {
+		SendErr(w, r, service.ErrForbidden)
+		return
+	}
+
+	setETag(w, card.Version)
+	SendJSON(w, card)
+}
+
+func (h *PatientHandler) PatientCard(w http.ResponseWriter, r *http.Request) {
+	patientID, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if !canAccessPatient(r.Context(), patientID, entity.ScopeCardsRead) {
+		SendErr(w, r, service.ErrForbidden)
+		return
+	}
+
+	card, err := h.srv.CardByPatientID(r.Context(), patientID)
 	if err != nil {
-		SendErr(w, http.StatusInsufficientStorage, err)
+		SendErr(w, r, err)
 		return
 	}
 
+	setETag(w, card.Version)
 	SendJSON(w, card)
 }
 
+func (h *PatientHandler) Cards(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := limitOffset(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	filter, err := cardFilter(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	cards, err := h.srv.Cards(r.Context(), filter, limit, offset)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	SendJSON(w, Page{Items: cards, Limit: limit, Offset: offset})
+}
+
+func (h *PatientHandler) DeleteCard(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	version, err := ifMatch(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.srv.DeleteCard(r.Context(), id, version)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "deleted card %d", id)
+
+	SendJSON(w, id)
+}
+
+// Consultation methods
+
+func (h *PatientHandler) AddConsultation(w http.ResponseWriter, r *http.Request) {
+	var consultation entity.Consultation
+
+	err := decodeJSON(r, &consultation)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	cardID, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	doctor, ok := DoctorFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrForbidden)
+		return
+	}
+
+	consultation.CardID = cardID
+	consultation.DoctorID = &doctor.ID
+	consultation.FullName = doctor.FullName
+
+	consultation, err = h.srv.AddConsultation(r.Context(), consultation)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "added consultation %d to card %d", consultation.ID, cardID)
+
+	SendJSON(w, consultation)
+}
+
+func (h *PatientHandler) CardConsultations(w http.ResponseWriter, r *http.Request) {
+	cardID, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	limit, offset, err := limitOffset(r)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	card, err := h.srv.CardByID(r.Context(), cardID)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if !canAccessPatient(r.Context(), card.PatientID, entity.ScopeCardsRead) {
+		SendErr(w, r, service.ErrForbidden)
+		return
+	}
+
+	consultations, err := h.srv.CardConsultations(r.Context(), card.ID, limit, offset)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	SendJSON(w, Page{Items: consultations, Limit: limit, Offset: offset})
+}
+
+func (h *PatientHandler) UpdateConsultation(w http.ResponseWriter, r *http.Request) {
+	var consultation entity.Consultation
+
+	err := decodeJSON(r, &consultation)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	cardID, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	id, err := pathID(r, "consultation_id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	consultation, err = h.srv.UpdateConsultation(r.Context(), cardID, id, consultation)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "updated consultation %d of card %d", id, cardID)
+
+	SendJSON(w, consultation)
+}
+
+// Doctor methods
+
+func (h *PatientHandler) AddDoctor(w http.ResponseWriter, r *http.Request) {
+	var doctor entity.Doctor
+
+	err := decodeJSON(r, &doctor)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if current, _ := DoctorFromContext(r.Context()); doctor.IsAdmin && !current.IsAdmin {
+		SendErr(w, r, fmt.Errorf("%w: only admins can create admins", service.ErrForbidden))
+		return
+	}
+
+	doctor, err = h.srv.AddDoctor(r.Context(), doctor)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	doctor.Sanitize()
+
+	SendJSON(w, doctor)
+}
+
 // Sessions
 
+func (h *PatientHandler) Me(w http.ResponseWriter, r *http.Request) {
+	if p, ok := PatientFromContext(r.Context()); ok {
+		p.Sanitize()
+		SendJSON(w, p)
+		return
+	}
+
+	if d, ok := DoctorFromContext(r.Context()); ok {
+		d.Sanitize()
+		SendJSON(w, d)
+		return
+	}
+
+	if k, ok := APIKeyFromContext(r.Context()); ok {
+		SendJSON(w, k)
+		return
+	}
+
+	SendErr(w, r, service.ErrUnauthorized)
+}
+
 func (h *PatientHandler) Login(w http.ResponseWriter, r *http.Request) {
-	var patient entity.Patient
+	var creds entity.Credentials
 
-	err := json.NewDecoder(r.Body).Decode(&patient)
+	err := decodeJSON(r, &creds)
 	if err != nil {
-		SendErr(w, http.StatusBadRequest, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	patient, err = h.srv.PatientByLogin(r.Context(), patient.Login)
+	sess, err := h.srv.Login(r.Context(), creds, clientIP(r))
 	if err != nil {
-		if errors.Is(err, service.ErrNotFound) || !patient.ComparePassword(patient.Password) {
-			SendErr(w, http.StatusUnauthorized, fmt.Errorf("%w: incorrect login or password", service.ErrUnauthorized))
-			return
-		}
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.cookies.StartSession(w, sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	SendJSON(w, entity.LoginResult{MFARequired: sess.MFA == entity.MFAPending})
+}
 
-		SendErr(w, http.StatusInternalServerError, err)
+// VerifySecondFactor completes a login that is waiting for a one-time code
+// and replaces the pending session cookie with a full one.
+func (h *PatientHandler) VerifySecondFactor(w http.ResponseWriter, r *http.Request) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
 		return
 	}
 
-	sess, err := h.srv.Login(r.Context(), patient.ID)
+	var body struct {
+		Code string `json:"code"`
+	}
+
+	err := decodeJSON(r, &body)
 	if err != nil {
-		SendErr(w, http.StatusInternalServerError, err)
+		SendErr(w, r, err)
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:    "ssid",
-		Value:   sess.ID.String(),
-		Expires: sess.ExpiredAt,
+	sess, err = h.srv.VerifySecondFactor(r.Context(), sess, body.Code, clientIP(r))
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.cookies.StartSession(w, sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	SendJSON(w, entity.LoginResult{})
+}
+
+func (h *PatientHandler) Signup(w http.ResponseWriter, r *http.Request) {
+	var patient entity.Patient
+
+	err := decodeJSON(r, &patient)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	patient, sess, err := h.srv.Signup(r.Context(), patient)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.cookies.StartSession(w, sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	patient.Sanitize()
+
+	SendJSON(w, patient)
+}
+
+func (h *PatientHandler) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	sess, err := h.srv.RefreshSession(r.Context(), sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	h.cookies.SetSession(w, sess)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	var err error
+	if r.URL.Query().Get("all") == "true" {
+		err = h.srv.LogoutAll(r.Context(), sess)
+	} else {
+		err = h.srv.Logout(r.Context(), sess, sess.ID.String())
+	}
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	h.cookies.ClearSession(w)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	ssid := mux.Vars(r)["id"]
+
+	err := h.srv.Logout(r.Context(), sess, ssid)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	if ssid == sess.ID.String() {
+		h.cookies.ClearSession(w)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) IssueTokens(w http.ResponseWriter, r *http.Request) {
+	var creds entity.Credentials
+
+	err := decodeJSON(r, &creds)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	tokens, err := h.srv.IssueTokens(r.Context(), creds, clientIP(r))
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, tokens)
+}
+
+func (h *PatientHandler) RefreshTokens(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := decodeJSON(r, &body)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	tokens, err := h.srv.RefreshTokens(r.Context(), body.RefreshToken)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, tokens)
+}
+
+func (h *PatientHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	var ch entity.PasswordChange
+
+	err := decodeJSON(r, &ch)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	// A bearer client has no use for a cookie; it gets new tokens for the
+	// session the password change ended.
+	if _, ok := bearerToken(r); ok {
+		tokens, err := h.srv.ChangePasswordTokens(r.Context(), sess, ch)
+		if err != nil {
+			SendErr(w, r, err)
+			return
+		}
+
+		audit(r.Context(), "changed password")
+
+		w.Header().Set("Cache-Control", "no-store")
+		SendJSON(w, tokens)
+		return
+	}
+
+	sess, err = h.srv.ChangePassword(r.Context(), sess, ch)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "changed password")
+
+	err = h.cookies.StartSession(w, sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req entity.PasswordResetRequest
+
+	err := decodeJSON(r, &req)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.srv.RequestPasswordReset(r.Context(), req)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *PatientHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+
+	err := decodeJSON(r, &body)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.srv.ResetPassword(r.Context(), mux.Vars(r)["token"], body.Password)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	var req entity.UnlockRequest
+
+	err := decodeJSON(r, &req)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.srv.UnlockAccount(r.Context(), req)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "unlocked %s %s", req.Role, req.Login)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var key entity.APIKey
+
+	err := decodeJSON(r, &key)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	key, err = h.srv.CreateAPIKey(r.Context(), key, sess.UserID)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "created api key %d (%s)", key.ID, key.Prefix)
+
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, key)
+}
+
+func (h *PatientHandler) APIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := h.srv.APIKeys(r.Context())
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	SendJSON(w, keys)
+}
+
+func (h *PatientHandler) RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	key, err := h.srv.RotateAPIKey(r.Context(), id)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "rotated api key %d (%s)", key.ID, key.Prefix)
+
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, key)
+}
+
+func (h *PatientHandler) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r, "id")
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.srv.RevokeAPIKey(r.Context(), id)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "revoked api key %d", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Single sign-on
+
+// StartOIDCLogin redirects the browser to the identity provider.
+func (h *PatientHandler) StartOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	redirectURL, state, err := h.srv.StartOIDCLogin(r.Context(), r.URL.Query().Get("return_to"))
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	h.cookies.SetOIDCState(w, state)
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// OIDCCallback is where the identity provider sends the browser back to. It
+// opens a session and redirects to the page the login was started from.
+func (h *PatientHandler) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	h.cookies.ClearOIDCState(w)
+
+	if e := q.Get("error"); e != "" {
+		SendErr(w, r, fmt.Errorf("%w: identity provider: %s %s", service.ErrUnauthorized, e, q.Get("error_description")))
+		return
+	}
+
+	state := q.Get("state")
+	if !h.cookies.CheckOIDCState(r, state) {
+		SendErr(w, r, fmt.Errorf("%w: login state does not match this browser", service.ErrUnauthorized))
+		return
+	}
+
+	sess, returnTo, err := h.srv.FinishOIDCLogin(r.Context(), state, q.Get("code"))
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.cookies.StartSession(w, sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(WithSession(r.Context(), sess), "signed in with single sign-on")
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, returnTo, http.StatusSeeOther)
+}
+
+// Two-factor authentication
+
+func (h *PatientHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return
+	}
+
+	enrollment, err := h.srv.EnrollTOTP(r.Context(), sess)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, enrollment)
+}
+
+func (h *PatientHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	sess, code, ok := h.sessionAndCode(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.srv.ConfirmTOTP(r.Context(), sess, code)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "enabled two-factor authentication")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	sess, code, ok := h.sessionAndCode(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.srv.DisableTOTP(r.Context(), sess, code)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "disabled two-factor authentication")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *PatientHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	sess, code, ok := h.sessionAndCode(w, r)
+	if !ok {
+		return
+	}
+
+	codes, err := h.srv.RegenerateRecoveryCodes(r.Context(), sess, code)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	SendJSON(w, struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{codes})
+}
+
+func (h *PatientHandler) ResetTOTP(w http.ResponseWriter, r *http.Request) {
+	var req entity.UnlockRequest
+
+	err := decodeJSON(r, &req)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	err = h.srv.ResetTOTP(r.Context(), req)
+	if err != nil {
+		SendErr(w, r, err)
+		return
+	}
+
+	audit(r.Context(), "reset two-factor authentication of %s %s", req.Role, req.Login)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sessionAndCode reads the caller's session and the one-time code from the
+// body, writing the error response itself when either is missing.
+func (h *PatientHandler) sessionAndCode(w http.ResponseWriter, r *http.Request) (entity.Session, string, bool) {
+	sess, ok := SessionFromContext(r.Context())
+	if !ok {
+		SendErr(w, r, service.ErrUnauthorized)
+		return sess, "", false
+	}
+
+	var body struct {
+		Code string `json:"code"`
+	}
+
+	err := decodeJSON(r, &body)
+	if err != nil {
+		SendErr(w, r, err)
+		return sess, "", false
+	}
+
+	return sess, body.Code, true
+}
+
+// canAccessPatient tells whether the caller may touch the records of a
+// patient: doctors always, patients only their own, API keys with scope.
+func canAccessPatient(ctx context.Context, patientID int64, scope string) bool {
+	sess, ok := SessionFromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	switch sess.Role {
+	case entity.RoleDoctor:
+		return true
+	case entity.RolePatient:
+		return sess.UserID == patientID
+	case entity.RoleService:
+		return hasScope(ctx, scope)
+	default:
+		return false
+	}
+}
+
+func patientQuery(r *http.Request) (pq entity.PatientQuery, err error) {
+	pq.Limit, _, err = limitOffset(r)
+	if err != nil {
+		return pq, err
+	}
+
+	q := r.URL.Query()
+
+	pq.Sort = entity.PatientSort(q.Get("sort"))
+	switch pq.Sort {
+	case "", entity.PatientSortFullName, entity.PatientSortCreatedAt, entity.PatientSortDateOfBorn:
+	default:
+		return pq, fmt.Errorf("%w: sort must be one of full_name, created_at, date_of_born", service.ErrInvalid)
+	}
+
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		pq.Desc = true
+	default:
+		return pq, fmt.Errorf("%w: order must be asc or desc", service.ErrInvalid)
+	}
+
+	if v := q.Get("after"); v != "" {
+		pq.After = &entity.PatientCursor{}
+
+		err = decodeCursor(v, pq.After)
+		if err != nil {
+			return pq, err
+		}
+	}
+
+	pq.Filter.City = q.Get("city")
+
+	if v := q.Get("min_age"); v != "" {
+		age, err := strconv.Atoi(v)
+		if err != nil || age < 0 {
+			return pq, fmt.Errorf("%w: invalid min_age", service.ErrInvalid)
+		}
+		pq.Filter.MinAge = &age
+	}
+
+	if v := q.Get("max_age"); v != "" {
+		age, err := strconv.Atoi(v)
+		if err != nil || age < 0 {
+			return pq, fmt.Errorf("%w: invalid max_age", service.ErrInvalid)
+		}
+		pq.Filter.MaxAge = &age
+	}
+
+	if v := q.Get("has_card"); v != "" {
+		hasCard, err := strconv.ParseBool(v)
+		if err != nil {
+			return pq, fmt.Errorf("%w: invalid has_card", service.ErrInvalid)
+		}
+		pq.Filter.HasCard = &hasCard
+	}
+
+	return pq, nil
+}
+
+func cardFilter(r *http.Request) (f entity.CardFilter, err error) {
+	q := r.URL.Query()
+
+	if v := q.Get("patient_id"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("%w: invalid patient_id", service.ErrInvalid)
+		}
+		f.PatientID = &id
+	}
+
+	if v := q.Get("blood_type"); v != "" {
+		bt, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("%w: invalid blood_type", service.ErrInvalid)
+		}
+		f.BloodType = &bt
+	}
+
+	if v := q.Get("rh_factor"); v != "" {
+		rh, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("%w: invalid rh_factor", service.ErrInvalid)
+		}
+		f.RhFactor = &rh
+	}
+
+	if v := q.Get("disability_group"); v != "" {
+		dg, err := strconv.Atoi(v)
+		if err != nil {
+			return f, fmt.Errorf("%w: invalid disability_group", service.ErrInvalid)
+		}
+		f.DisabilityGroup = &dg
 	}
 
-	http.SetCookie(w, cookie)
+	return f, nil
 }
@@ -1,19 +1,26 @@
 package api
 
 import (
+	"context"
+	"errors"
+	"expvar"
 	"net/http"
+	"time"
+
+	"medical-card/internal/entity"
 
 	"github.com/gorilla/mux"
 )
 
 type Server struct {
-	r      *mux.Router
-	srv    *http.Server
-	ph     *PatientHandler
-	authMw *AuthMiddleware
+	r               *mux.Router
+	srv             *http.Server
+	shutdownTimeout time.Duration
+	ph              *PatientHandler
+	authMw          *AuthMiddleware
 }
 
-func NewServer(port string, ph *PatientHandler, authMw *AuthMiddleware) *Server {
+func NewServer(port string, shutdownTimeout time.Duration, ph *PatientHandler, authMw *AuthMiddleware) *Server {
 	r := mux.NewRouter()
 
 	srv := &http.Server{
@@ -21,28 +28,132 @@ func NewServer(port string, ph *PatientHandler, authMw *AuthMiddleware) *Server
 		Handler: r,
 	}
 
-	return &Server{
-		r:      r,
-		srv:    srv,
-		ph:     ph,
-		authMw: authMw,
+	s := &Server{
+		r:               r,
+		srv:             srv,
+		shutdownTimeout: shutdownTimeout,
+		ph:              ph,
+		authMw:          authMw,
 	}
+	s.routes()
+
+	return s
+}
+
+// Handler returns the router serving the API.
+func (s *Server) Handler() http.Handler {
+	return s.r
 }
 
-func (s *Server) Start() error {
+func (s *Server) routes() {
+	doctorOnly := s.authMw.RequireRole(entity.RoleDoctor)
+	userOnly := s.authMw.RequireRole(entity.RolePatient, entity.RoleDoctor)
+	doctorOr := func(scope string) mux.MiddlewareFunc {
+		return s.authMw.RequireRoleOrScope(scope, entity.RoleDoctor)
+	}
+
+	s.r.Use(RequestID)
+
+	// Patients are returned with their card, so the 2FA policy covers all of
+	// /patients and not just the card paths.
 	p := s.r.PathPrefix("/patients").Subrouter()
-	p.Use(s.authMw.Require)
+	p.Use(s.authMw.Require, s.authMw.RequireMFAPolicy)
 
-	p.HandleFunc("", s.ph.AddPatient).Methods(http.MethodPost)
-	p.HandleFunc("", s.ph.Patients).Methods(http.MethodGet)
-	p.HandleFunc("/{passport_number}", s.ph.PatientByPassportNumber).Methods(http.MethodGet)
+	p.Handle("", doctorOr(entity.ScopePatientsWrite)(http.HandlerFunc(s.ph.AddPatient))).Methods(http.MethodPost)
+	p.Handle("", doctorOr(entity.ScopePatientsRead)(http.HandlerFunc(s.ph.Patients))).Methods(http.MethodGet)
+	p.Handle("/search", doctorOr(entity.ScopePatientsRead)(http.HandlerFunc(s.ph.SearchPatients))).Methods(http.MethodGet)
+	p.Handle("/{passport_number}", doctorOr(entity.ScopePatientsRead)(http.HandlerFunc(s.ph.PatientByPassportNumber))).Methods(http.MethodGet)
 	p.HandleFunc("/{id}", s.ph.UpdatePatient).Methods(http.MethodPut)
-	p.HandleFunc("/{id}", s.ph.DeletePatient).Methods(http.MethodDelete)
+	p.HandleFunc("/{id}", s.ph.PatchPatient).Methods(http.MethodPatch)
+	p.Handle("/{id}", doctorOnly(http.HandlerFunc(s.ph.DeletePatient))).Methods(http.MethodDelete)
+	p.Handle("/{id}/card", http.HandlerFunc(s.ph.PatientCard)).Methods(http.MethodGet)
 
-	p.HandleFunc("/cards", s.ph.AddCard).Methods(http.MethodPost)
-	p.HandleFunc("/cards/{id}", s.ph.UpdateCard).Methods(http.MethodPut)
+	// The card write paths under /patients predate /cards and are kept for
+	// existing clients.
+	p.Handle("/cards", doctorOr(entity.ScopeCardsWrite)(http.HandlerFunc(s.ph.AddCard))).Methods(http.MethodPost)
+	p.Handle("/cards/{id}", doctorOr(entity.ScopeCardsWrite)(http.HandlerFunc(s.ph.UpdateCard))).Methods(http.MethodPut)
+
+	c := s.r.PathPrefix("/cards").Subrouter()
+	c.Use(s.authMw.Require, s.authMw.RequireMFAPolicy)
+
+	c.Handle("", doctorOr(entity.ScopeCardsWrite)(http.HandlerFunc(s.ph.AddCard))).Methods(http.MethodPost)
+	c.Handle("", doctorOr(entity.ScopeCardsRead)(http.HandlerFunc(s.ph.Cards))).Methods(http.MethodGet)
+	c.HandleFunc("/{id}", s.ph.CardByID).Methods(http.MethodGet)
+	c.Handle("/{id}", doctorOr(entity.ScopeCardsWrite)(http.HandlerFunc(s.ph.UpdateCard))).Methods(http.MethodPut)
+	c.Handle("/{id}", doctorOr(entity.ScopeCardsWrite)(http.HandlerFunc(s.ph.PatchCard))).Methods(http.MethodPatch)
+	c.Handle("/{id}", doctorOnly(http.HandlerFunc(s.ph.DeleteCard))).Methods(http.MethodDelete)
+
+	c.Handle("/{id}/consultations", doctorOnly(http.HandlerFunc(s.ph.AddConsultation))).Methods(http.MethodPost)
+	c.HandleFunc("/{id}/consultations", s.ph.CardConsultations).Methods(http.MethodGet)
+	c.Handle("/{id}/consultations/{consultation_id}", doctorOnly(http.HandlerFunc(s.ph.UpdateConsultation))).Methods(http.MethodPut)
+
+	d := s.r.PathPrefix("/doctors").Subrouter()
+	d.Use(s.authMw.Require, doctorOnly)
+
+	d.HandleFunc("", s.ph.AddDoctor).Methods(http.MethodPost)
+
+	s.r.Handle("/me", s.authMw.Require(http.HandlerFunc(s.ph.Me))).Methods(http.MethodGet)
+	s.r.Handle("/me/password", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.ChangePassword)))).Methods(http.MethodPost)
+	s.r.Handle("/me/2fa", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.EnrollTOTP)))).Methods(http.MethodPost)
+	s.r.Handle("/me/2fa", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.DisableTOTP)))).Methods(http.MethodDelete)
+	s.r.Handle("/me/2fa/confirm", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.ConfirmTOTP)))).Methods(http.MethodPost)
+	s.r.Handle("/me/2fa/recovery-codes", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.RegenerateRecoveryCodes)))).Methods(http.MethodPost)
 
 	s.r.HandleFunc("/sessions", s.ph.Login).Methods(http.MethodPost)
+	s.r.Handle("/sessions", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.Logout)))).Methods(http.MethodDelete)
+	s.r.Handle("/sessions/2fa", s.authMw.RequirePending(http.HandlerFunc(s.ph.VerifySecondFactor))).Methods(http.MethodPost)
+	s.r.Handle("/sessions/refresh", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.RefreshSession)))).Methods(http.MethodPost)
+	s.r.Handle("/sessions/{id}", s.authMw.Require(userOnly(http.HandlerFunc(s.ph.DeleteSession)))).Methods(http.MethodDelete)
+	s.r.HandleFunc("/signup", s.ph.Signup).Methods(http.MethodPost)
+
+	s.r.HandleFunc("/oidc/login", s.ph.StartOIDCLogin).Methods(http.MethodGet)
+	s.r.HandleFunc("/oidc/callback", s.ph.OIDCCallback).Methods(http.MethodGet)
+
+	s.r.HandleFunc("/tokens", s.ph.IssueTokens).Methods(http.MethodPost)
+	s.r.HandleFunc("/tokens/refresh", s.ph.RefreshTokens).Methods(http.MethodPost)
+
+	s.r.HandleFunc("/password-resets", s.ph.RequestPasswordReset).Methods(http.MethodPost)
+	s.r.HandleFunc("/password-resets/{token}", s.ph.ResetPassword).Methods(http.MethodPost)
+
+	a := s.r.PathPrefix("/admin").Subrouter()
+	a.Use(s.authMw.Require, s.authMw.RequireAdmin)
+
+	a.HandleFunc("/unlock", s.ph.UnlockAccount).Methods(http.MethodPost)
+	a.HandleFunc("/2fa/reset", s.ph.ResetTOTP).Methods(http.MethodPost)
+	a.HandleFunc("/api-keys", s.ph.CreateAPIKey).Methods(http.MethodPost)
+	a.HandleFunc("/api-keys", s.ph.APIKeys).Methods(http.MethodGet)
+	a.HandleFunc("/api-keys/{id}/rotate", s.ph.RotateAPIKey).Methods(http.MethodPost)
+	a.HandleFunc("/api-keys/{id}", s.ph.RevokeAPIKey).Methods(http.MethodDelete)
+
+	s.r.Handle("/debug/vars", s.authMw.Require(doctorOnly(expvar.Handler()))).Methods(http.MethodGet)
+}
+
+// Start serves requests until ctx is cancelled, then stops accepting new
+// connections and waits up to the shutdown timeout for in-flight requests.
+func (s *Server) Start(ctx context.Context) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	err := s.srv.Shutdown(shutdownCtx)
+	if err != nil {
+		return err
+	}
+
+	err = <-errCh
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
 
-	return s.srv.ListenAndServe()
+	return err
 }
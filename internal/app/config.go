@@ -1,14 +1,25 @@
 package app
 
 import (
+	"time"
+
 	"github.com/caarlos0/env/v7"
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	Port string `env:"PORT"`
+	Port            string        `env:"PORT"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"15s"`
 
-	Database DBConfig
+	Database      DBConfig
+	Session       SessionConfig
+	Cookie        CookieConfig
+	JWT           JWTConfig
+	PasswordReset PasswordResetConfig
+	LoginThrottle LoginThrottleConfig
+	TOTP          TOTPConfig
+	OIDC          OIDCConfig
+	Admin         AdminConfig
 }
 
 type DBConfig struct {
@@ -19,6 +30,89 @@ type DBConfig struct {
 	Password string `env:"DB_PASSWORD"`
 }
 
+type SessionConfig struct {
+	TTL         time.Duration `env:"SESSION_TTL" envDefault:"30m"`
+	MaxLifetime time.Duration `env:"SESSION_MAX_LIFETIME" envDefault:"12h"`
+	Sliding     bool          `env:"SESSION_SLIDING" envDefault:"true"`
+
+	PurgeInterval  time.Duration `env:"SESSION_PURGE_INTERVAL" envDefault:"10m"`
+	PurgeBatchSize int           `env:"SESSION_PURGE_BATCH_SIZE" envDefault:"1000"`
+}
+
+// CookieConfig sets the attributes of the session and CSRF cookies. The
+// session cookie is always HttpOnly.
+type CookieConfig struct {
+	Domain   string `env:"COOKIE_DOMAIN"`
+	Path     string `env:"COOKIE_PATH" envDefault:"/"`
+	Secure   bool   `env:"COOKIE_SECURE" envDefault:"true"`
+	SameSite string `env:"COOKIE_SAME_SITE" envDefault:"lax"`
+}
+
+// JWTConfig configures the HS256 access tokens of bearer clients. Keys maps
+// key ids to secrets and every one of them is accepted, so SigningKeyID can
+// be rotated without invalidating tokens already handed out. Without keys
+// only cookie sessions are offered.
+type JWTConfig struct {
+	Issuer       string            `env:"JWT_ISSUER" envDefault:"medical-card"`
+	Audience     string            `env:"JWT_AUDIENCE" envDefault:"medical-card"`
+	AccessTTL    time.Duration     `env:"JWT_ACCESS_TTL" envDefault:"15m"`
+	Keys         map[string]string `env:"JWT_KEYS"`
+	SigningKeyID string            `env:"JWT_SIGNING_KEY_ID"`
+}
+
+type PasswordResetConfig struct {
+	TTL time.Duration `env:"PASSWORD_RESET_TTL" envDefault:"30m"`
+}
+
+// LoginThrottleConfig controls the backoff applied after failed logins.
+// Counters are kept per account and per client address; the address limits
+// are looser since many users may share one.
+type LoginThrottleConfig struct {
+	Window             time.Duration `env:"LOGIN_ATTEMPTS_WINDOW" envDefault:"1h"`
+	FreeAttempts       int           `env:"LOGIN_FREE_ATTEMPTS" envDefault:"3"`
+	LockoutThreshold   int           `env:"LOGIN_LOCKOUT_THRESHOLD" envDefault:"10"`
+	IPFreeAttempts     int           `env:"LOGIN_IP_FREE_ATTEMPTS" envDefault:"20"`
+	IPLockoutThreshold int           `env:"LOGIN_IP_LOCKOUT_THRESHOLD" envDefault:"100"`
+	BaseDelay          time.Duration `env:"LOGIN_BASE_DELAY" envDefault:"1s"`
+	MaxDelay           time.Duration `env:"LOGIN_MAX_DELAY" envDefault:"5m"`
+	LockoutDuration    time.Duration `env:"LOGIN_LOCKOUT_DURATION" envDefault:"30m"`
+}
+
+// TOTPConfig configures two-factor authentication. A session opened with a
+// password only is pending until the second factor is shown and expires
+// after PendingTTL.
+type TOTPConfig struct {
+	Issuer             string        `env:"TOTP_ISSUER" envDefault:"Medical Card"`
+	PendingTTL         time.Duration `env:"TOTP_PENDING_TTL" envDefault:"5m"`
+	RequiredForDoctors bool          `env:"TOTP_REQUIRED_FOR_DOCTORS" envDefault:"true"`
+}
+
+// OIDCConfig enables single sign-on for staff through an OpenID Connect
+// provider; it is off while Issuer is empty. Users whose RolesClaim holds
+// DoctorRole are signed in as doctors, created on first login, and
+// AdminRole makes them admins. RolesClaim may name a nested claim with dots.
+type OIDCConfig struct {
+	Issuer       string        `env:"OIDC_ISSUER"`
+	ClientID     string        `env:"OIDC_CLIENT_ID"`
+	ClientSecret string        `env:"OIDC_CLIENT_SECRET"`
+	RedirectURL  string        `env:"OIDC_REDIRECT_URL"`
+	Scopes       []string      `env:"OIDC_SCOPES" envDefault:"openid,profile,email"`
+	RolesClaim   string        `env:"OIDC_ROLES_CLAIM" envDefault:"roles"`
+	DoctorRole   string        `env:"OIDC_DOCTOR_ROLE" envDefault:"doctor"`
+	AdminRole    string        `env:"OIDC_ADMIN_ROLE" envDefault:"admin"`
+	LoginTTL     time.Duration `env:"OIDC_LOGIN_TTL" envDefault:"10m"`
+	HTTPTimeout  time.Duration `env:"OIDC_HTTP_TIMEOUT" envDefault:"10s"`
+}
+
+// AdminConfig names the admin doctor created when the server starts with no
+// doctors at all; nothing is created while Login is empty.
+type AdminConfig struct {
+	Login          string `env:"ADMIN_LOGIN"`
+	Password       string `env:"ADMIN_PASSWORD"`
+	FullName       string `env:"ADMIN_FULL_NAME" envDefault:"Administrator"`
+	Specialization string `env:"ADMIN_SPECIALIZATION" envDefault:"Administration"`
+}
+
 func NewConfig() (c Config, err error) {
 	err = godotenv.Load(".env")
 	if err != nil {
@@ -0,0 +1,74 @@
+package dal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"medical-card/internal/service"
+
+	"github.com/lib/pq"
+)
+
+const (
+	pqNotNullViolation    = "23502"
+	pqForeignKeyViolation = "23503"
+	pqUniqueViolation     = "23505"
+	pqCheckViolation      = "23514"
+)
+
+// mapError translates constraint violations reported by Postgres into
+// service errors naming the offending field. Other errors are returned as is.
+func mapError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+
+	var target error
+	switch pqErr.Code {
+	case pqUniqueViolation:
+		target = service.ErrAlreadyExists
+	case pqForeignKeyViolation:
+		target = service.ErrConflict
+	case pqNotNullViolation, pqCheckViolation:
+		target = service.ErrInvalid
+	default:
+		return err
+	}
+
+	return &service.ConstraintError{
+		Field: constraintField(pqErr),
+		Err:   target,
+	}
+}
+
+func constraintField(pqErr *pq.Error) string {
+	if pqErr.Column != "" {
+		return pqErr.Column
+	}
+
+	// Postgres names default constraints <table>_<column>_<suffix>.
+	field := strings.TrimPrefix(pqErr.Constraint, pqErr.Table+"_")
+	for _, suffix := range []string{"_key", "_fkey", "_check", "_pkey"} {
+		field = strings.TrimSuffix(field, suffix)
+	}
+
+	return field
+}
+
+// checkVersion reports ErrVersionConflict when a conditional write matched
+// no row, i.e. somebody else changed the row since it was read.
+func checkVersion(res sql.Result, kind string, id int64) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%s with id %d: %w", kind, id, service.ErrVersionConflict)
+	}
+
+	return nil
+}
@@ -5,21 +5,58 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"medical-card/internal/entity"
 	"medical-card/internal/service"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
 var _ service.PatientRepository = (*PatientRepository)(nil)
 
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 type PatientRepository struct {
-	db *sql.DB
+	conn *sql.DB
+	db   querier
 }
 
 func NewPatientRepository(db *sql.DB) *PatientRepository {
 	return &PatientRepository{
-		db: db,
+		conn: db,
+		db:   db,
+	}
+}
+
+func (r *PatientRepository) WithTx(ctx context.Context, fn func(repo service.PatientRepository) error) error {
+	if _, ok := r.db.(*sql.Tx); ok {
+		return fn(r)
+	}
+
+	tx, err := r.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = fn(&PatientRepository{conn: r.conn, db: tx})
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("commit tx: %w", err)
 	}
+
+	return nil
 }
 
 // Patient methods
@@ -36,10 +73,26 @@ func (r *PatientRepository) PatientByID(ctx context.Context, id int64) (entity.P
 	return r.findPatientByColumn(ctx, "id", id)
 }
 
+// LockPatient locks the patient row until the end of the transaction.
+func (r *PatientRepository) LockPatient(ctx context.Context, id int64) error {
+	var locked int64
+
+	err := r.db.QueryRowContext(ctx, "SELECT id FROM patients WHERE id = $1 FOR UPDATE", id).Scan(&locked)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("lock patient %d: %w", id, service.ErrNotFound)
+		}
+
+		return fmt.Errorf("lock patient %d: %w", id, err)
+	}
+
+	return nil
+}
+
 func (r *PatientRepository) CreatePatient(ctx context.Context, p entity.Patient) (entity.Patient, error) {
 	q := `
 INSERT INTO patients (full_name, data_of_born, address, phone_number, passport_number, login, password, created_at, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id, version
 `
 	err := r.db.QueryRowContext(
 		ctx,
@@ -53,23 +106,82 @@ VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id
 		p.Password,
 		p.CreatedAt,
 		p.UpdatedAt).
-		Scan(&p.ID)
+		Scan(&p.ID, &p.Version)
 
-	return p, err
+	return p, mapError(err)
 }
 
-func (r *PatientRepository) Patients(ctx context.Context) ([]entity.Patient, error) {
-	q := `
-SELECT id, full_name, data_of_born, address, phone_number, passport_number, login, created_at
-FROM patients 
-`
-	rows, err := r.db.QueryContext(ctx, q)
+var patientSortColumns = map[entity.PatientSort]string{
+	entity.PatientSortFullName:   "full_name",
+	entity.PatientSortCreatedAt:  "created_at",
+	entity.PatientSortDateOfBorn: "data_of_born",
+}
+
+var patientSortCasts = map[entity.PatientSort]string{
+	entity.PatientSortFullName:   "TEXT",
+	entity.PatientSortCreatedAt:  "TIMESTAMPTZ",
+	entity.PatientSortDateOfBorn: "DATE",
+}
+
+func (r *PatientRepository) Patients(ctx context.Context, pq entity.PatientQuery) ([]entity.Patient, error) {
+	col, ok := patientSortColumns[pq.Sort]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort %q", service.ErrInvalid, pq.Sort)
+	}
+
+	var (
+		where []string
+		args  []any
+	)
+
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	f := pq.Filter
+	now := time.Now()
+
+	if f.City != "" {
+		where = append(where, "lower(address->>'city') = lower("+arg(f.City)+")")
+	}
+	if f.MinAge != nil {
+		where = append(where, "data_of_born <= "+arg(now.AddDate(-*f.MinAge, 0, 0)))
+	}
+	if f.MaxAge != nil {
+		where = append(where, "data_of_born > "+arg(now.AddDate(-*f.MaxAge-1, 0, 0)))
+	}
+	if f.HasCard != nil {
+		exists := "EXISTS (SELECT 1 FROM cards c WHERE c.patient_id = patients.id)"
+		if !*f.HasCard {
+			exists = "NOT " + exists
+		}
+		where = append(where, exists)
+	}
+
+	op, order := ">", "ASC"
+	if pq.Desc {
+		op, order = "<", "DESC"
+	}
+
+	if pq.After != nil {
+		where = append(where, fmt.Sprintf("(%s, id) %s (%s::%s, %s)",
+			col, op, arg(pq.After.Value), patientSortCasts[pq.Sort], arg(pq.After.ID)))
+	}
+
+	q := "SELECT id, full_name, data_of_born, address, phone_number, passport_number, login, created_at, updated_at, version FROM patients"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", col, order, order, arg(pq.Limit))
+
+	rows, err := r.db.QueryContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var patients []entity.Patient
+	patients := []entity.Patient{}
 
 	for rows.Next() {
 		var p entity.Patient
@@ -83,6 +195,8 @@ FROM patients
 			&p.PassportNumber,
 			&p.Login,
 			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Version,
 		)
 		if err != nil {
 			return nil, err
@@ -91,17 +205,70 @@ FROM patients
 		patients = append(patients, p)
 	}
 
-	return patients, nil
+	return patients, rows.Err()
+}
+
+func (r *PatientRepository) SearchPatients(ctx context.Context, query string, limit int) ([]entity.PatientSearchResult, error) {
+	q := `
+SELECT id, full_name, data_of_born, address, phone_number, passport_number, login, created_at, updated_at, version,
+       GREATEST(
+           word_similarity($1, full_name),
+           similarity(phone_number, $1),
+           word_similarity($1, address_text)
+       ) + ts_rank(search_document, plainto_tsquery('simple', $1)) AS rank
+FROM patients
+WHERE $1 <% full_name
+   OR $1 <% address_text
+   OR phone_number LIKE '%' || $2 || '%'
+   OR search_document @@ plainto_tsquery('simple', $1)
+ORDER BY rank DESC, id
+LIMIT $3
+`
+	rows, err := r.db.QueryContext(ctx, q, query, escapeLike(query), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []entity.PatientSearchResult{}
+
+	for rows.Next() {
+		var p entity.PatientSearchResult
+
+		err = rows.Scan(
+			&p.ID,
+			&p.FullName,
+			&p.DateOfBorn,
+			&p.Address,
+			&p.PhoneNumber,
+			&p.PassportNumber,
+			&p.Login,
+			&p.CreatedAt,
+			&p.UpdatedAt,
+			&p.Version,
+			&p.Rank,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, p)
+	}
+
+	return results, rows.Err()
 }
 
+// UpdatePatient only succeeds while the stored version still equals
+// p.Version and bumps it, so a concurrent writer gets ErrVersionConflict.
 func (r *PatientRepository) UpdatePatient(ctx context.Context, id int64, p entity.Patient) error {
 	q := `
 UPDATE patients
-SET full_name = $1, data_of_born = $2, address = $3, phone_number = $4, passport_number = $5, login = $6, updated_at = $7
-WHERE id = $8
+SET full_name = $1, data_of_born = $2, address = $3, phone_number = $4, passport_number = $5, login = $6, updated_at = $7,
+    version = version + 1
+WHERE id = $8 AND version = $9
 `
 
-	_, err := r.db.ExecContext(
+	res, err := r.db.ExecContext(
 		ctx,
 		q,
 		p.FullName,
@@ -111,28 +278,30 @@ WHERE id = $8
 		p.PassportNumber,
 		p.Login,
 		p.UpdatedAt,
-		id)
+		id,
+		p.Version)
 	if err != nil {
-		return err
+		return mapError(err)
 	}
 
-	return nil
+	return checkVersion(res, "patient", id)
 }
 
-func (r *PatientRepository) DeletePatient(ctx context.Context, id int64) error {
-	q := "DELETE FROM patients WHERE id = $1"
+func (r *PatientRepository) DeletePatient(ctx context.Context, id, version int64) error {
+	q := "DELETE FROM patients WHERE id = $1 AND version = $2"
 
-	_, err := r.db.ExecContext(ctx, q, id)
-
-	err = r.deleteCard(ctx, id)
+	res, err := r.db.ExecContext(ctx, q, id, version)
+	if err != nil {
+		return mapError(err)
+	}
 
-	return err
+	return checkVersion(res, "patient", id)
 }
 
 func (r *PatientRepository) findPatientByColumn(ctx context.Context, col string, value any) (entity.Patient, error) {
 	var p entity.Patient
 
-	q := "SELECT id, full_name, data_of_born, address, phone_number, passport_number, login, created_at, updated_at FROM patients"
+	q := "SELECT id, full_name, data_of_born, address, phone_number, passport_number, login, password, created_at, updated_at, version FROM patients"
 	q = fmt.Sprintf("%s WHERE %s = $1", q, col)
 
 	err := r.db.QueryRowContext(ctx, q, value).
@@ -144,8 +313,10 @@ func (r *PatientRepository) findPatientByColumn(ctx context.Context, col string,
 			&p.PhoneNumber,
 			&p.PassportNumber,
 			&p.Login,
+			&p.EncryptedPassword,
 			&p.CreatedAt,
 			&p.UpdatedAt,
+			&p.Version,
 		)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -155,7 +326,7 @@ func (r *PatientRepository) findPatientByColumn(ctx context.Context, col string,
 		return p, fmt.Errorf("get patient by %s %v: %w", col, value, err)
 	}
 
-	c, err := r.patientCard(ctx, p.ID)
+	c, err := r.CardByPatientID(ctx, p.ID)
 	if err != nil {
 		if errors.Is(err, service.ErrNotFound) {
 			return p, nil
@@ -169,12 +340,16 @@ func (r *PatientRepository) findPatientByColumn(ctx context.Context, col string,
 	return p, nil
 }
 
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
 // Card methods
 
 func (r *PatientRepository) CreateCard(ctx context.Context, c entity.Card) (entity.Card, error) {
 	q := `
-INSERT INTO cards (patient_id, chronic_diseases, disability_group, blood_type, rh_factor, consultations, created_at, updated_at)
-VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+INSERT INTO cards (patient_id, chronic_diseases, disability_group, blood_type, rh_factor, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, version
 `
 	err := r.db.QueryRowContext(
 		ctx,
@@ -184,18 +359,17 @@ VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
 		c.DisabilityGroup,
 		c.BloodType,
 		c.RhFactor,
-		c.Consultations,
 		c.CreatedAt,
-		c.UpdatedAt).Scan(&c.ID)
+		c.UpdatedAt).Scan(&c.ID, &c.Version)
 
-	return c, err
+	return c, mapError(err)
 }
 
 func (r *PatientRepository) CardByID(ctx context.Context, id int64) (entity.Card, error) {
 	var c entity.Card
 
 	q := `
-SELECT id, patient_id, chronic_diseases, disability_group, blood_type, rh_factor, consultations, created_at, updated_at
+SELECT id, patient_id, chronic_diseases, disability_group, blood_type, rh_factor, created_at, updated_at, version
 FROM cards
 WHERE id = $1
 `
@@ -208,9 +382,9 @@ WHERE id = $1
 			&c.DisabilityGroup,
 			&c.BloodType,
 			&c.RhFactor,
-			&c.Consultations,
 			&c.CreatedAt,
 			&c.UpdatedAt,
+			&c.Version,
 		)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -226,30 +400,35 @@ WHERE id = $1
 func (r *PatientRepository) UpdateCard(ctx context.Context, id int64, c entity.Card) error {
 	q := `
 UPDATE cards
-SET patient_id = $1,  chronic_diseases = $2, disability_group = $3, blood_type = $4, rh_factor = $5, consultations = $6
-WHERE id = $7
+SET patient_id = $1, chronic_diseases = $2, disability_group = $3, blood_type = $4, rh_factor = $5, updated_at = $6,
+    version = version + 1
+WHERE id = $7 AND version = $8
 `
 
-	_, err := r.db.ExecContext(
+	res, err := r.db.ExecContext(
 		ctx,
 		q,
-		&c.PatientID,
-		&c.ChronicDiseases,
-		&c.DisabilityGroup,
-		&c.BloodType,
-		&c.RhFactor,
-		&c.Consultations,
+		c.PatientID,
+		c.ChronicDiseases,
+		c.DisabilityGroup,
+		c.BloodType,
+		c.RhFactor,
+		c.UpdatedAt,
 		id,
+		c.Version,
 	)
+	if err != nil {
+		return mapError(err)
+	}
 
-	return err
+	return checkVersion(res, "card", id)
 }
 
-func (r *PatientRepository) patientCard(ctx context.Context, patientID int64) (entity.Card, error) {
+func (r *PatientRepository) CardByPatientID(ctx context.Context, patientID int64) (entity.Card, error) {
 	var c entity.Card
 
 	q := `
-SELECT id, patient_id, chronic_diseases, disability_group, blood_type, rh_factor, consultations, created_at, updated_at
+SELECT id, patient_id, chronic_diseases, disability_group, blood_type, rh_factor, created_at, updated_at, version
 FROM cards
 WHERE patient_id = $1
 `
@@ -262,9 +441,9 @@ WHERE patient_id = $1
 			&c.DisabilityGroup,
 			&c.BloodType,
 			&c.RhFactor,
-			&c.Consultations,
 			&c.CreatedAt,
 			&c.UpdatedAt,
+			&c.Version,
 		)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -277,36 +456,833 @@ WHERE patient_id = $1
 	return c, nil
 }
 
-func (r *PatientRepository) deleteCard(ctx context.Context, patientID int64) error {
-	q := "DELETE FROM cards WHERE patient_id = $1"
+func (r *PatientRepository) Cards(ctx context.Context, f entity.CardFilter, limit, offset int) ([]entity.Card, error) {
+	var (
+		where []string
+		args  []any
+	)
 
-	_, err := r.db.ExecContext(ctx, q, patientID)
+	addCond := func(col string, value any) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf("%s = $%d", col, len(args)))
+	}
 
-	return err
+	if f.PatientID != nil {
+		addCond("patient_id", *f.PatientID)
+	}
+	if f.BloodType != nil {
+		addCond("blood_type", *f.BloodType)
+	}
+	if f.RhFactor != nil {
+		addCond("rh_factor", *f.RhFactor)
+	}
+	if f.DisabilityGroup != nil {
+		addCond("disability_group", *f.DisabilityGroup)
+	}
+
+	q := "SELECT id, patient_id, chronic_diseases, disability_group, blood_type, rh_factor, created_at, updated_at, version FROM cards"
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	args = append(args, limit, offset)
+	q += fmt.Sprintf(" ORDER BY id LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cards := []entity.Card{}
+
+	for rows.Next() {
+		var c entity.Card
+
+		err = rows.Scan(
+			&c.ID,
+			&c.PatientID,
+			&c.ChronicDiseases,
+			&c.DisabilityGroup,
+			&c.BloodType,
+			&c.RhFactor,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+			&c.Version,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		cards = append(cards, c)
+	}
+
+	return cards, rows.Err()
 }
 
-// Session
+func (r *PatientRepository) DeleteCard(ctx context.Context, id, version int64) error {
+	q := "DELETE FROM consultations WHERE card_id = $1"
+
+	_, err := r.db.ExecContext(ctx, q, id)
+	if err != nil {
+		return mapError(err)
+	}
+
+	q = "DELETE FROM cards WHERE id = $1 AND version = $2"
+
+	res, err := r.db.ExecContext(ctx, q, id, version)
+	if err != nil {
+		return mapError(err)
+	}
+
+	return checkVersion(res, "card", id)
+}
+
+// Consultation methods
+
+func (r *PatientRepository) CreateConsultation(ctx context.Context, c entity.Consultation) (entity.Consultation, error) {
+	q := `
+INSERT INTO consultations (card_id, doctor_id, full_name, complaints, descriptions, recommendations, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id
+`
+	err := r.db.QueryRowContext(
+		ctx,
+		q,
+		c.CardID,
+		c.DoctorID,
+		c.FullName,
+		c.Complaints,
+		c.Descriptions,
+		c.Recommendations,
+		c.CreatedAt,
+		c.UpdatedAt).Scan(&c.ID)
+
+	return c, mapError(err)
+}
+
+func (r *PatientRepository) ConsultationByID(ctx context.Context, id int64) (entity.Consultation, error) {
+	var c entity.Consultation
+
+	q := `
+SELECT id, card_id, doctor_id, full_name, complaints, descriptions, recommendations, created_at, updated_at
+FROM consultations
+WHERE id = $1
+`
+
+	err := r.db.QueryRowContext(ctx, q, id).
+		Scan(
+			&c.ID,
+			&c.CardID,
+			&c.DoctorID,
+			&c.FullName,
+			&c.Complaints,
+			&c.Descriptions,
+			&c.Recommendations,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return c, service.ErrNotFound
+		}
+
+		return c, err
+	}
+
+	return c, nil
+}
+
+func (r *PatientRepository) CardConsultations(ctx context.Context, cardID int64, limit, offset int) ([]entity.Consultation, error) {
+	q := `
+SELECT id, card_id, doctor_id, full_name, complaints, descriptions, recommendations, created_at, updated_at
+FROM consultations
+WHERE card_id = $1
+ORDER BY id
+LIMIT $2 OFFSET $3
+`
+	rows, err := r.db.QueryContext(ctx, q, cardID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-func (r *PatientRepository) Login(ctx context.Context, sess entity.Session) error {
+	consultations := []entity.Consultation{}
+
+	for rows.Next() {
+		var c entity.Consultation
+
+		err = rows.Scan(
+			&c.ID,
+			&c.CardID,
+			&c.DoctorID,
+			&c.FullName,
+			&c.Complaints,
+			&c.Descriptions,
+			&c.Recommendations,
+			&c.CreatedAt,
+			&c.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		consultations = append(consultations, c)
+	}
+
+	return consultations, rows.Err()
+}
+
+func (r *PatientRepository) UpdateConsultation(ctx context.Context, id int64, c entity.Consultation) error {
 	q := `
-INSERT INTO sessions (id, patient_id, created_at, expired_at) VALUES ($1, $2, $3, $4)
+UPDATE consultations
+SET complaints = $1, descriptions = $2, recommendations = $3, updated_at = $4
+WHERE id = $5
 `
-	_, err := r.db.ExecContext(ctx, q, sess.ID, sess.PatientID, sess.CreatedAt, sess.ExpiredAt)
+
+	_, err := r.db.ExecContext(
+		ctx,
+		q,
+		c.Complaints,
+		c.Descriptions,
+		c.Recommendations,
+		c.UpdatedAt,
+		id,
+	)
+
+	return mapError(err)
+}
+
+// Doctor methods
+
+func (r *PatientRepository) CreateDoctor(ctx context.Context, d entity.Doctor) (entity.Doctor, error) {
+	q := `
+INSERT INTO doctors (full_name, specialization, login, password, is_admin, oidc_subject, created_at, updated_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id
+`
+	err := r.db.QueryRowContext(
+		ctx,
+		q,
+		d.FullName,
+		d.Specialization,
+		d.Login,
+		d.Password,
+		d.IsAdmin,
+		d.OIDCSubject,
+		d.CreatedAt,
+		d.UpdatedAt).
+		Scan(&d.ID)
+
+	return d, mapError(err)
+}
+
+func (r *PatientRepository) DoctorByID(ctx context.Context, id int64) (entity.Doctor, error) {
+	return r.findDoctorByColumn(ctx, "id", id)
+}
+
+func (r *PatientRepository) DoctorByLogin(ctx context.Context, login string) (entity.Doctor, error) {
+	return r.findDoctorByColumn(ctx, "login", login)
+}
+
+func (r *PatientRepository) HasDoctors(ctx context.Context) (bool, error) {
+	var exists bool
+
+	err := r.db.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM doctors)").Scan(&exists)
+
+	return exists, err
+}
+
+func (r *PatientRepository) DoctorByOIDCSubject(ctx context.Context, subject string) (entity.Doctor, error) {
+	return r.findDoctorByColumn(ctx, "oidc_subject", subject)
+}
+
+// UpdateDoctorIdentity stores the name and admin flag the identity provider
+// reported for a single sign-on doctor.
+func (r *PatientRepository) UpdateDoctorIdentity(ctx context.Context, d entity.Doctor) error {
+	q := "UPDATE doctors SET full_name = $1, is_admin = $2, updated_at = $3 WHERE id = $4"
+
+	_, err := r.db.ExecContext(ctx, q, d.FullName, d.IsAdmin, d.UpdatedAt, d.ID)
+
 	return err
 }
 
-func (r *PatientRepository) SessionByID(ctx context.Context, id string) (sess entity.Session, err error) {
-	q := "SELECT id, patient_id, created_at, expired_at FROM sessions WHERE id = $1"
+func (r *PatientRepository) findDoctorByColumn(ctx context.Context, col string, value any) (entity.Doctor, error) {
+	var d entity.Doctor
+
+	q := "SELECT id, full_name, specialization, login, password, is_admin, oidc_subject, created_at, updated_at FROM doctors"
+	q = fmt.Sprintf("%s WHERE %s = $1", q, col)
 
-	err = r.db.QueryRowContext(ctx, q, id).
-		Scan(&sess.ID, &sess.PatientID, &sess.CreatedAt, &sess.ExpiredAt)
+	err := r.db.QueryRowContext(ctx, q, value).
+		Scan(
+			&d.ID,
+			&d.FullName,
+			&d.Specialization,
+			&d.Login,
+			&d.EncryptedPassword,
+			&d.IsAdmin,
+			&d.OIDCSubject,
+			&d.CreatedAt,
+			&d.UpdatedAt,
+		)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return sess, service.ErrNotFound
+			return d, fmt.Errorf("get doctor by %s %v: %w", col, value, service.ErrNotFound)
 		}
 
-		return sess, err
+		return d, fmt.Errorf("get doctor by %s %v: %w", col, value, err)
 	}
 
-	return sess, nil
+	return d, nil
+}
+
+// Session
+
+func (r *PatientRepository) CreateSession(ctx context.Context, sess entity.Session) error {
+	q := `
+INSERT INTO sessions (id, user_id, role, mfa, created_at, expired_at, refresh_token_hash, token_id)
+VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
+`
+	_, err := r.db.ExecContext(ctx, q, sess.ID, sess.UserID, sess.Role, sess.MFA, sess.CreatedAt, sess.ExpiredAt, sess.RefreshTokenHash, sess.TokenID)
+	return err
+}
+
+func (r *PatientRepository) SessionByID(ctx context.Context, id string) (entity.Session, error) {
+	return r.findSessionByColumn(ctx, "id", id)
+}
+
+func (r *PatientRepository) SessionByRefreshToken(ctx context.Context, hash string) (entity.Session, error) {
+	return r.findSessionByColumn(ctx, "refresh_token_hash", hash)
+}
+
+func (r *PatientRepository) SessionByTokenID(ctx context.Context, tokenID string) (entity.Session, error) {
+	return r.findSessionByColumn(ctx, "token_id", tokenID)
+}
+
+// UpdateSessionRefreshToken replaces the refresh token hash only if it still
+// equals oldHash, so the same refresh token cannot be redeemed twice. The
+// token id is stored along with it.
+func (r *PatientRepository) UpdateSessionRefreshToken(ctx context.Context, id uuid.UUID, tokenID, oldHash, newHash string) error {
+	q := `
+UPDATE sessions SET refresh_token_hash = $1, token_id = $2
+WHERE id = $3 AND refresh_token_hash IS NOT DISTINCT FROM NULLIF($4, '')
+`
+
+	res, err := r.db.ExecContext(ctx, q, newHash, tokenID, id, oldHash)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("session %s: %w", id, service.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (r *PatientRepository) findSessionByColumn(ctx context.Context, col string, value any) (sess entity.Session, err error) {
+	q := "SELECT id, user_id, role, mfa, created_at, expired_at, COALESCE(refresh_token_hash, ''), COALESCE(token_id, '') FROM sessions"
+	q = fmt.Sprintf("%s WHERE %s = $1", q, col)
+
+	err = r.db.QueryRowContext(ctx, q, value).
+		Scan(&sess.ID, &sess.UserID, &sess.Role, &sess.MFA, &sess.CreatedAt, &sess.ExpiredAt, &sess.RefreshTokenHash, &sess.TokenID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return sess, service.ErrNotFound
+		}
+
+		return sess, err
+	}
+
+	return sess, nil
+}
+
+func (r *PatientRepository) UpdateSessionExpiry(ctx context.Context, id uuid.UUID, expiredAt time.Time) error {
+	q := "UPDATE sessions SET expired_at = $1 WHERE id = $2"
+
+	_, err := r.db.ExecContext(ctx, q, expiredAt, id)
+
+	return err
+}
+
+func (r *PatientRepository) DeleteSession(ctx context.Context, id string) error {
+	q := "DELETE FROM sessions WHERE id = $1"
+
+	_, err := r.db.ExecContext(ctx, q, id)
+
+	return err
+}
+
+func (r *PatientRepository) DeleteUserSessions(ctx context.Context, userID int64, role entity.Role) error {
+	q := "DELETE FROM sessions WHERE user_id = $1 AND role = $2"
+
+	_, err := r.db.ExecContext(ctx, q, userID, role)
+
+	return err
+}
+
+func (r *PatientRepository) DeleteExpiredSessions(ctx context.Context, before time.Time, limit int) (int64, error) {
+	q := `
+DELETE FROM sessions
+WHERE id IN (SELECT id FROM sessions WHERE expired_at < $1 LIMIT $2)
+`
+
+	res, err := r.db.ExecContext(ctx, q, before, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Password methods
+
+var roleTables = map[entity.Role]string{
+	entity.RolePatient: "patients",
+	entity.RoleDoctor:  "doctors",
+}
+
+func (r *PatientRepository) UpdatePassword(ctx context.Context, userID int64, role entity.Role, hash string) error {
+	table, ok := roleTables[role]
+	if !ok {
+		return fmt.Errorf("update password: unknown role %q", role)
+	}
+
+	q := fmt.Sprintf("UPDATE %s SET password = $1 WHERE id = $2", table)
+
+	res, err := r.db.ExecContext(ctx, q, hash, userID)
+	if err != nil {
+		return mapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%s %d: %w", role, userID, service.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (r *PatientRepository) CreatePasswordReset(ctx context.Context, pr entity.PasswordReset) error {
+	q := `
+INSERT INTO password_resets (token_hash, user_id, role, created_at, expired_at) VALUES ($1, $2, $3, $4, $5)
+`
+	_, err := r.db.ExecContext(ctx, q, pr.TokenHash, pr.UserID, pr.Role, pr.CreatedAt, pr.ExpiredAt)
+
+	return mapError(err)
+}
+
+// UsePasswordReset marks an unused, unexpired reset as used and returns it.
+// Doing both in one statement keeps a token from being redeemed twice.
+func (r *PatientRepository) UsePasswordReset(ctx context.Context, tokenHash string, now time.Time) (pr entity.PasswordReset, err error) {
+	q := `
+UPDATE password_resets
+SET used_at = $2
+WHERE token_hash = $1 AND used_at IS NULL AND expired_at > $2
+RETURNING token_hash, user_id, role, created_at, expired_at, used_at
+`
+
+	err = r.db.QueryRowContext(ctx, q, tokenHash, now).
+		Scan(&pr.TokenHash, &pr.UserID, &pr.Role, &pr.CreatedAt, &pr.ExpiredAt, &pr.UsedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return pr, service.ErrNotFound
+		}
+
+		return pr, err
+	}
+
+	return pr, nil
+}
+
+// Login attempt methods
+
+func (r *PatientRepository) LoginAttempts(ctx context.Context, keys []string) ([]entity.LoginAttempt, error) {
+	q := "SELECT key, failures, last_failure_at, locked_until FROM login_attempts WHERE key = ANY($1)"
+
+	rows, err := r.db.QueryContext(ctx, q, pq.Array(keys))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []entity.LoginAttempt{}
+
+	for rows.Next() {
+		var a entity.LoginAttempt
+
+		err = rows.Scan(&a.Key, &a.Failures, &a.LastFailureAt, &a.LockedUntil)
+		if err != nil {
+			return nil, err
+		}
+
+		attempts = append(attempts, a)
+	}
+
+	return attempts, rows.Err()
+}
+
+// RecordLoginFailure bumps the failure counter of key and returns it. A
+// counter whose last failure is older than windowStart starts over.
+func (r *PatientRepository) RecordLoginFailure(ctx context.Context, key string, now, windowStart time.Time) (int, error) {
+	q := `
+INSERT INTO login_attempts (key, failures, last_failure_at) VALUES ($1, 1, $2)
+ON CONFLICT (key) DO UPDATE
+SET failures = CASE WHEN login_attempts.last_failure_at < $3 THEN 1 ELSE login_attempts.failures + 1 END,
+    last_failure_at = $2
+RETURNING failures
+`
+
+	var failures int
+
+	err := r.db.QueryRowContext(ctx, q, key, now, windowStart).Scan(&failures)
+
+	return failures, err
+}
+
+func (r *PatientRepository) LockLogin(ctx context.Context, key string, until time.Time) error {
+	q := "UPDATE login_attempts SET locked_until = $2 WHERE key = $1"
+
+	_, err := r.db.ExecContext(ctx, q, key, until)
+
+	return err
+}
+
+func (r *PatientRepository) DeleteLoginAttempts(ctx context.Context, key string) error {
+	q := "DELETE FROM login_attempts WHERE key = $1"
+
+	_, err := r.db.ExecContext(ctx, q, key)
+
+	return err
+}
+
+// API key methods
+
+func (r *PatientRepository) CreateAPIKey(ctx context.Context, k entity.APIKey) (entity.APIKey, error) {
+	q := `
+INSERT INTO api_keys (name, prefix, key_hash, scopes, created_by, created_at)
+VALUES ($1, $2, $3, $4, $5, $6) RETURNING id
+`
+	err := r.db.QueryRowContext(
+		ctx,
+		q,
+		k.Name,
+		k.Prefix,
+		k.KeyHash,
+		pq.Array(k.Scopes),
+		k.CreatedBy,
+		k.CreatedAt).
+		Scan(&k.ID)
+
+	return k, mapError(err)
+}
+
+func (r *PatientRepository) APIKeys(ctx context.Context) ([]entity.APIKey, error) {
+	q := "SELECT id, name, prefix, key_hash, scopes, created_by, created_at, last_used_at, revoked_at FROM api_keys ORDER BY id"
+
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []entity.APIKey{}
+
+	for rows.Next() {
+		var k entity.APIKey
+
+		err = rows.Scan(
+			&k.ID,
+			&k.Name,
+			&k.Prefix,
+			&k.KeyHash,
+			pq.Array(&k.Scopes),
+			&k.CreatedBy,
+			&k.CreatedAt,
+			&k.LastUsedAt,
+			&k.RevokedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+func (r *PatientRepository) APIKeyByID(ctx context.Context, id int64) (entity.APIKey, error) {
+	return r.findAPIKeyByColumn(ctx, "id", id)
+}
+
+func (r *PatientRepository) APIKeyByHash(ctx context.Context, hash string) (entity.APIKey, error) {
+	return r.findAPIKeyByColumn(ctx, "key_hash", hash)
+}
+
+func (r *PatientRepository) UpdateAPIKeyHash(ctx context.Context, id int64, prefix, hash string) error {
+	q := "UPDATE api_keys SET prefix = $1, key_hash = $2 WHERE id = $3 AND revoked_at IS NULL"
+
+	res, err := r.db.ExecContext(ctx, q, prefix, hash, id)
+	if err != nil {
+		return mapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("active api key %d: %w", id, service.ErrNotFound)
+	}
+
+	return nil
+}
+
+func (r *PatientRepository) RevokeAPIKey(ctx context.Context, id int64, now time.Time) error {
+	q := "UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL"
+
+	res, err := r.db.ExecContext(ctx, q, now, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("active api key %d: %w", id, service.ErrNotFound)
+	}
+
+	return nil
+}
+
+// TouchAPIKey records that a key was used. It writes at most once a minute
+// per key so that busy integrations do not turn every read into a write.
+func (r *PatientRepository) TouchAPIKey(ctx context.Context, id int64, now time.Time) error {
+	q := `
+UPDATE api_keys SET last_used_at = $1
+WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $1 - INTERVAL '1 minute')
+`
+
+	_, err := r.db.ExecContext(ctx, q, now, id)
+
+	return err
+}
+
+func (r *PatientRepository) findAPIKeyByColumn(ctx context.Context, col string, value any) (entity.APIKey, error) {
+	var k entity.APIKey
+
+	q := "SELECT id, name, prefix, key_hash, scopes, created_by, created_at, last_used_at, revoked_at FROM api_keys"
+	q = fmt.Sprintf("%s WHERE %s = $1", q, col)
+
+	err := r.db.QueryRowContext(ctx, q, value).
+		Scan(
+			&k.ID,
+			&k.Name,
+			&k.Prefix,
+			&k.KeyHash,
+			pq.Array(&k.Scopes),
+			&k.CreatedBy,
+			&k.CreatedAt,
+			&k.LastUsedAt,
+			&k.RevokedAt,
+		)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return k, fmt.Errorf("get api key by %s: %w", col, service.ErrNotFound)
+		}
+
+		return k, fmt.Errorf("get api key by %s: %w", col, err)
+	}
+
+	return k, nil
+}
+
+// Two-factor methods
+
+func (r *PatientRepository) TOTPByUser(ctx context.Context, userID int64, role entity.Role) (t entity.TOTP, err error) {
+	q := `
+SELECT user_id, role, secret, enabled_at, last_used_step, created_at
+FROM user_totp
+WHERE user_id = $1 AND role = $2
+`
+
+	err = r.db.QueryRowContext(ctx, q, userID, role).
+		Scan(&t.UserID, &t.Role, &t.Secret, &t.EnabledAt, &t.LastUsedStep, &t.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return t, fmt.Errorf("totp of %s %d: %w", role, userID, service.ErrNotFound)
+		}
+
+		return t, err
+	}
+
+	return t, nil
+}
+
+// SaveTOTP stores a new, not yet enabled secret, replacing an earlier
+// enrollment that was never confirmed.
+func (r *PatientRepository) SaveTOTP(ctx context.Context, t entity.TOTP) error {
+	q := `
+INSERT INTO user_totp (user_id, role, secret, last_used_step, created_at) VALUES ($1, $2, $3, 0, $4)
+ON CONFLICT (user_id, role) DO UPDATE
+SET secret = EXCLUDED.secret, last_used_step = 0, created_at = EXCLUDED.created_at
+WHERE user_totp.enabled_at IS NULL
+`
+
+	res, err := r.db.ExecContext(ctx, q, t.UserID, t.Role, t.Secret, t.CreatedAt)
+	if err != nil {
+		return mapError(err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("totp of %s %d: %w", t.Role, t.UserID, service.ErrAlreadyExists)
+	}
+
+	return nil
+}
+
+func (r *PatientRepository) EnableTOTP(ctx context.Context, userID int64, role entity.Role, enabledAt time.Time) error {
+	q := "UPDATE user_totp SET enabled_at = $1 WHERE user_id = $2 AND role = $3"
+
+	_, err := r.db.ExecContext(ctx, q, enabledAt, userID, role)
+
+	return err
+}
+
+// UseTOTPStep records the time step of an accepted code. It fails with
+// ErrConflict if that step or a later one was used already, so every code
+// works once.
+func (r *PatientRepository) UseTOTPStep(ctx context.Context, userID int64, role entity.Role, step int64) error {
+	q := "UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND role = $3 AND last_used_step < $1"
+
+	res, err := r.db.ExecContext(ctx, q, step, userID, role)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("totp of %s %d: code already used: %w", role, userID, service.ErrConflict)
+	}
+
+	return nil
+}
+
+func (r *PatientRepository) DeleteTOTP(ctx context.Context, userID int64, role entity.Role) error {
+	q := "DELETE FROM totp_recovery_codes WHERE user_id = $1 AND role = $2"
+
+	_, err := r.db.ExecContext(ctx, q, userID, role)
+	if err != nil {
+		return err
+	}
+
+	q = "DELETE FROM user_totp WHERE user_id = $1 AND role = $2"
+
+	_, err = r.db.ExecContext(ctx, q, userID, role)
+
+	return err
+}
+
+func (r *PatientRepository) ReplaceRecoveryCodes(ctx context.Context, userID int64, role entity.Role, hashes []string) error {
+	q := "DELETE FROM totp_recovery_codes WHERE user_id = $1 AND role = $2"
+
+	_, err := r.db.ExecContext(ctx, q, userID, role)
+	if err != nil {
+		return err
+	}
+
+	q = `
+INSERT INTO totp_recovery_codes (user_id, role, code_hash)
+SELECT $1, $2, unnest($3::TEXT[])
+`
+
+	_, err = r.db.ExecContext(ctx, q, userID, role, pq.Array(hashes))
+
+	return mapError(err)
+}
+
+func (r *PatientRepository) UseRecoveryCode(ctx context.Context, userID int64, role entity.Role, hash string, now time.Time) error {
+	q := `
+UPDATE totp_recovery_codes SET used_at = $1
+WHERE user_id = $2 AND role = $3 AND code_hash = $4 AND used_at IS NULL
+`
+
+	res, err := r.db.ExecContext(ctx, q, now, userID, role, hash)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return fmt.Errorf("recovery code of %s %d: %w", role, userID, service.ErrNotFound)
+	}
+
+	return nil
+}
+
+// Single sign-on methods
+
+// CreateOIDCLogin stores a started login and drops the ones that expired.
+func (r *PatientRepository) CreateOIDCLogin(ctx context.Context, l entity.OIDCLogin) error {
+	q := "DELETE FROM oidc_logins WHERE expired_at <= $1"
+
+	_, err := r.db.ExecContext(ctx, q, l.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	q = `
+INSERT INTO oidc_logins (state_hash, code_verifier, nonce, return_to, created_at, expired_at)
+VALUES ($1, $2, $3, $4, $5, $6)
+`
+	_, err = r.db.ExecContext(ctx, q, l.StateHash, l.CodeVerifier, l.Nonce, l.ReturnTo, l.CreatedAt, l.ExpiredAt)
+
+	return mapError(err)
+}
+
+// UseOIDCLogin deletes an unexpired login and returns it, so that a state
+// can be redeemed once only.
+func (r *PatientRepository) UseOIDCLogin(ctx context.Context, stateHash string, now time.Time) (l entity.OIDCLogin, err error) {
+	q := `
+DELETE FROM oidc_logins
+WHERE state_hash = $1 AND expired_at > $2
+RETURNING state_hash, code_verifier, nonce, return_to, created_at, expired_at
+`
+
+	err = r.db.QueryRowContext(ctx, q, stateHash, now).
+		Scan(&l.StateHash, &l.CodeVerifier, &l.Nonce, &l.ReturnTo, &l.CreatedAt, &l.ExpiredAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return l, service.ErrNotFound
+		}
+
+		return l, err
+	}
+
+	return l, nil
 }
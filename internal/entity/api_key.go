@@ -0,0 +1,38 @@
+package entity
+
+import "time"
+
+const (
+	ScopePatientsRead  = "patients:read"
+	ScopePatientsWrite = "patients:write"
+	ScopeCardsRead     = "cards:read"
+	ScopeCardsWrite    = "cards:write"
+)
+
+var Scopes = []string{ScopePatientsRead, ScopePatientsWrite, ScopeCardsRead, ScopeCardsWrite}
+
+// APIKey lets another system call the API without a user session. Key holds
+// the plain key right after it is created or rotated and is empty otherwise;
+// only its hash is stored.
+type APIKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Key        string     `json:"key,omitempty"`
+	KeyHash    string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedBy  *int64     `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
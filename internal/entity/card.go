@@ -14,9 +14,9 @@ type Card struct {
 	DisabilityGroup *int            `json:"disability_group,omitempty"`
 	BloodType       int             `json:"blood_type,omitempty"`
 	RhFactor        bool            `json:"rh_factor,omitempty"`
-	Consultations   Consultations   `json:"consultations,omitempty"`
 	CreatedAt       time.Time       `json:"created_at"`
 	UpdatedAt       time.Time       `json:"updated_at"`
+	Version         int64           `json:"version"`
 }
 
 type ChronicDiseases []string
@@ -24,7 +24,7 @@ type ChronicDiseases []string
 type Consultation struct {
 	ID              int64     `json:"id,omitempty"`
 	CardID          int64     `json:"card_id,omitempty"`
-	DoctorID        string    `json:"doctor_id,omitempty"`
+	DoctorID        *int64    `json:"doctor_id,omitempty"`
 	FullName        string    `json:"full_name,omitempty"`
 	Complaints      string    `json:"complaints,omitempty"`
 	Descriptions    string    `json:"descriptions,omitempty"`
@@ -33,8 +33,6 @@ type Consultation struct {
 	UpdatedAt       time.Time `json:"updated_at"`
 }
 
-type Consultations []Consultation
-
 func (c ChronicDiseases) Value() (driver.Value, error) {
 	return json.Marshal(c)
 }
@@ -48,15 +46,9 @@ func (c *ChronicDiseases) Scan(value any) error {
 	return json.Unmarshal(b, &c)
 }
 
-func (c Consultations) Value() (driver.Value, error) {
-	return json.Marshal(c)
-}
-
-func (c *Consultations) Scan(value any) error {
-	b, ok := value.([]byte)
-	if !ok {
-		return errors.New("type assertion to []byte failed")
-	}
-
-	return json.Unmarshal(b, &c)
+type CardFilter struct {
+	PatientID       *int64
+	BloodType       *int
+	RhFactor        *bool
+	DisabilityGroup *int
 }
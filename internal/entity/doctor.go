@@ -0,0 +1,28 @@
+package entity
+
+import (
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+type Doctor struct {
+	ID                int64     `json:"id"`
+	FullName          string    `json:"full_name"`
+	Specialization    string    `json:"specialization"`
+	Login             string    `json:"login"`
+	Password          string    `json:"password,omitempty"`
+	EncryptedPassword string    `json:"-"`
+	IsAdmin           bool      `json:"is_admin"`
+	OIDCSubject       *string   `json:"-"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+func (d *Doctor) Sanitize() {
+	d.Password = ""
+}
+
+func (d *Doctor) ComparePassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(d.EncryptedPassword), []byte(password)) == nil
+}
@@ -0,0 +1,17 @@
+package entity
+
+import "time"
+
+// LoginAttempt counts recent failed logins for one key, which is either an
+// account or a client address.
+type LoginAttempt struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+type UnlockRequest struct {
+	Login string `json:"login"`
+	Role  Role   `json:"role"`
+}
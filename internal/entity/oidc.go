@@ -0,0 +1,25 @@
+package entity
+
+import "time"
+
+// OIDCLogin is a single sign-on attempt between the redirect to the identity
+// provider and the callback. Only a hash of the state is stored.
+type OIDCLogin struct {
+	StateHash    string
+	CodeVerifier string
+	Nonce        string
+	ReturnTo     string
+	CreatedAt    time.Time
+	ExpiredAt    time.Time
+}
+
+// OIDCIdentity is what the identity provider vouches for in an ID token.
+type OIDCIdentity struct {
+	Subject  string
+	Login    string
+	FullName string
+	Roles    []string
+
+	// MFA tells whether the provider checked a second factor.
+	MFA bool
+}
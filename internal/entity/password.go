@@ -0,0 +1,24 @@
+package entity
+
+import "time"
+
+// PasswordReset is a pending reset. Only the SHA-256 of the token is kept so
+// that a leaked table cannot be used to take over accounts.
+type PasswordReset struct {
+	TokenHash string
+	UserID    int64
+	Role      Role
+	CreatedAt time.Time
+	ExpiredAt time.Time
+	UsedAt    *time.Time
+}
+
+type PasswordResetRequest struct {
+	Login string `json:"login"`
+	Role  Role   `json:"role"`
+}
+
+type PasswordChange struct {
+	OldPassword string `json:"old_password"`
+	NewPassword string `json:"new_password"`
+}
@@ -22,6 +22,7 @@ type Patient struct {
 	Card              *Card     `json:"card"`
 	CreatedAt         time.Time `json:"created_at"`
 	UpdatedAt         time.Time `json:"updated_at"`
+	Version           int64     `json:"version"`
 }
 
 type Address struct {
@@ -52,3 +53,40 @@ func (p *Patient) Sanitize() {
 func (p *Patient) ComparePassword(password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(p.EncryptedPassword), []byte(password)) == nil
 }
+
+type PatientSort string
+
+const (
+	PatientSortFullName   PatientSort = "full_name"
+	PatientSortCreatedAt  PatientSort = "created_at"
+	PatientSortDateOfBorn PatientSort = "date_of_born"
+)
+
+type PatientFilter struct {
+	City    string
+	MinAge  *int
+	MaxAge  *int
+	HasCard *bool
+}
+
+// PatientCursor points at the last patient of a page. Value holds that
+// patient's sort key so the next page can continue right after it.
+type PatientCursor struct {
+	Sort  PatientSort `json:"s"`
+	Desc  bool        `json:"d,omitempty"`
+	Value string      `json:"v"`
+	ID    int64       `json:"id"`
+}
+
+type PatientQuery struct {
+	Filter PatientFilter
+	Sort   PatientSort
+	Desc   bool
+	Limit  int
+	After  *PatientCursor
+}
+
+type PatientSearchResult struct {
+	Patient
+	Rank float64 `json:"rank"`
+}
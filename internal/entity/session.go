@@ -6,9 +6,59 @@ import (
 	"github.com/google/uuid"
 )
 
+type Role string
+
+const (
+	RolePatient Role = "patient"
+	RoleDoctor  Role = "doctor"
+
+	// RoleService is the role of requests authenticated by an API key.
+	RoleService Role = "service"
+)
+
 type Session struct {
 	ID        uuid.UUID
-	PatientID int64
+	UserID    int64
+	Role      Role
+	MFA       MFAState
 	CreatedAt time.Time
 	ExpiredAt time.Time
+
+	// RefreshTokenHash is set for sessions opened by a bearer client.
+	RefreshTokenHash string
+
+	// TokenID names the session in access tokens. Unlike ID, which is the
+	// cookie value, it cannot be used to authenticate by itself.
+	TokenID string
+}
+
+func (s Session) HasRole(roles ...Role) bool {
+	for _, role := range roles {
+		if s.Role == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+type Credentials struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Role     Role   `json:"role"`
+
+	// OTP is an optional authenticator or recovery code that lets users with
+	// 2FA log in in one step.
+	OTP string `json:"otp,omitempty"`
+}
+
+type LoginResult struct {
+	MFARequired bool `json:"mfa_required"`
+}
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
 }
@@ -0,0 +1,30 @@
+package entity
+
+import "time"
+
+// TOTP is a user's authenticator secret. It only counts as a second factor
+// once EnabledAt is set, i.e. the user proved the authenticator works.
+type TOTP struct {
+	UserID       int64
+	Role         Role
+	Secret       string
+	EnabledAt    *time.Time
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// TOTPEnrollment is shown to the user once, when they set up 2FA.
+type TOTPEnrollment struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"otpauth_uri"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// MFAState tells how far a session got with two-factor authentication.
+type MFAState string
+
+const (
+	MFANone     MFAState = ""
+	MFAPending  MFAState = "pending"
+	MFAVerified MFAState = "verified"
+)
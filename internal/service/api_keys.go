@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+const (
+	apiKeyPrefix       = "mc_"
+	apiKeyPrefixLength = 8
+)
+
+// CreateAPIKey registers a key for another system. The plain key is only
+// returned here, so the caller has to pass it on right away.
+func (s *PatientService) CreateAPIKey(ctx context.Context, k entity.APIKey, createdBy int64) (entity.APIKey, error) {
+	err := validateAPIKey(k)
+	if err != nil {
+		return k, err
+	}
+
+	k.Key, k.Prefix, k.KeyHash, err = newAPIKey()
+	if err != nil {
+		return k, err
+	}
+
+	k.CreatedBy = &createdBy
+	k.CreatedAt = time.Now()
+	k.LastUsedAt = nil
+	k.RevokedAt = nil
+
+	k, err = s.repo.CreateAPIKey(ctx, k)
+	if err != nil {
+		return k, fmt.Errorf("create api key: %w", err)
+	}
+
+	return k, nil
+}
+
+func (s *PatientService) APIKeys(ctx context.Context) ([]entity.APIKey, error) {
+	return s.repo.APIKeys(ctx)
+}
+
+// RotateAPIKey replaces the secret of an active key and keeps its name and
+// scopes. The old secret stops working immediately.
+func (s *PatientService) RotateAPIKey(ctx context.Context, id int64) (entity.APIKey, error) {
+	var k entity.APIKey
+
+	err := s.withTx(ctx, func(tx *PatientService) error {
+		var err error
+
+		k, err = tx.repo.APIKeyByID(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		k.Key, k.Prefix, k.KeyHash, err = newAPIKey()
+		if err != nil {
+			return err
+		}
+
+		return tx.repo.UpdateAPIKeyHash(ctx, id, k.Prefix, k.KeyHash)
+	})
+
+	return k, err
+}
+
+func (s *PatientService) RevokeAPIKey(ctx context.Context, id int64) error {
+	return s.repo.RevokeAPIKey(ctx, id, time.Now())
+}
+
+// APIKeyByKey authenticates a plain key and records its use.
+func (s *PatientService) APIKeyByKey(ctx context.Context, key string) (entity.APIKey, error) {
+	errInvalid := fmt.Errorf("%w: invalid api key", ErrUnauthorized)
+
+	k, err := s.repo.APIKeyByHash(ctx, hashToken(key))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return k, errInvalid
+		}
+
+		return k, err
+	}
+
+	if k.RevokedAt != nil {
+		return entity.APIKey{}, errInvalid
+	}
+
+	err = s.repo.TouchAPIKey(ctx, k.ID, time.Now())
+	if err != nil {
+		return k, fmt.Errorf("touch api key: %w", err)
+	}
+
+	return k, nil
+}
+
+// newAPIKey returns a plain key, the prefix shown to admins to tell keys
+// apart, and the hash that is stored.
+func newAPIKey() (key, prefix, hash string, err error) {
+	token, err := newToken()
+	if err != nil {
+		return "", "", "", err
+	}
+
+	key = apiKeyPrefix + token
+
+	return key, key[:len(apiKeyPrefix)+apiKeyPrefixLength], hashToken(key), nil
+}
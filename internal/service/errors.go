@@ -2,11 +2,78 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
 var (
-	ErrAlreadyExists = errors.New("already exists")
-	ErrNotFound      = errors.New("not found")
-	ErrInternal      = errors.New("internal error")
-	ErrUnauthorized  = errors.New("unauthorized")
+	ErrAlreadyExists   = errors.New("already exists")
+	ErrNotFound        = errors.New("not found")
+	ErrInternal        = errors.New("internal error")
+	ErrUnauthorized    = errors.New("unauthorized")
+	ErrForbidden       = errors.New("forbidden")
+	ErrInvalid         = errors.New("invalid")
+	ErrConflict        = errors.New("conflict")
+	ErrTooManyAttempts = errors.New("too many attempts")
+
+	// ErrVersionConflict is returned by conditional writes when the stored
+	// row no longer has the version the caller read.
+	ErrVersionConflict = errors.New("version conflict")
+
+	// ErrPreconditionRequired is returned when a write that must be
+	// conditioned on a version does not name one.
+	ErrPreconditionRequired = errors.New("precondition required")
 )
+
+// ConstraintError reports which field broke a uniqueness, reference or
+// integrity rule.
+type ConstraintError struct {
+	Field string
+	Err   error
+}
+
+func (e *ConstraintError) Error() string {
+	return e.Field + ": " + e.Err.Error()
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// LockoutError tells a client how long to wait before it may try to log in
+// again.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("%s: retry in %s", ErrTooManyAttempts, e.RetryAfter.Round(time.Second))
+}
+
+func (e *LockoutError) Unwrap() error {
+	return ErrTooManyAttempts
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a payload that failed validation.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+" "+f.Message)
+	}
+
+	return ErrInvalid.Error() + ": " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalid
+}
@@ -0,0 +1,140 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+const (
+	jwtAlgorithm   = "HS256"
+	minJWTKeySize  = 32
+	jwtClockLeeway = 30 * time.Second
+)
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// accessClaims are the claims of an access token. TokenID ties the token
+// to a sessions row so that revoking the session revokes the token too.
+// It is not the session id, which would double as a session cookie.
+type accessClaims struct {
+	Issuer    string      `json:"iss"`
+	Subject   string      `json:"sub"`
+	Audience  string      `json:"aud"`
+	IssuedAt  int64       `json:"iat"`
+	ExpiresAt int64       `json:"exp"`
+	TokenID   string      `json:"tid"`
+	Role      entity.Role `json:"role"`
+}
+
+func signJWT(claims accessClaims, kid string, key []byte) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: jwtAlgorithm, Type: "JWT", KeyID: kid})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(key, signingInput)), nil
+}
+
+// parseJWT checks the signature of an HS256 token against the key named by
+// its kid and returns its claims. Time and audience checks are left to the
+// caller.
+func parseJWT(token string, keys map[string]string) (accessClaims, error) {
+	var claims accessClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, fmt.Errorf("malformed header: %w", err)
+	}
+
+	var header jwtHeader
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		return claims, fmt.Errorf("malformed header: %w", err)
+	}
+
+	if header.Algorithm != jwtAlgorithm {
+		return claims, fmt.Errorf("unexpected algorithm %q", header.Algorithm)
+	}
+
+	key, ok := keys[header.KeyID]
+	if !ok || len(key) < minJWTKeySize {
+		return claims, fmt.Errorf("unknown key %q", header.KeyID)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	if !hmac.Equal(signature, hmacSHA256([]byte(key), parts[0]+"."+parts[1])) {
+		return claims, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return claims, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	return claims, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+
+	return mac.Sum(nil)
+}
+
+// validateJWTOptions makes sure access tokens can be signed and that no key
+// is too short to resist brute force. Without keys bearer tokens are off,
+// which is fine.
+func validateJWTOptions(o JWTOptions) error {
+	if len(o.Keys) == 0 {
+		return nil
+	}
+
+	if _, ok := o.Keys[o.SigningKeyID]; !ok {
+		return fmt.Errorf("jwt signing key %q is not among the configured keys", o.SigningKeyID)
+	}
+
+	for kid, key := range o.Keys {
+		if len(key) < minJWTKeySize {
+			return fmt.Errorf("jwt key %q is shorter than %d bytes", kid, minJWTKeySize)
+		}
+	}
+
+	if o.AccessTTL <= 0 {
+		return fmt.Errorf("jwt access token ttl must be positive, got %s", o.AccessTTL)
+	}
+
+	return nil
+}
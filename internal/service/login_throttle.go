@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+// loginKeys are the login_attempts rows a login attempt is counted against.
+// The address key is empty when the client address is unknown.
+type loginKeys struct {
+	account string
+	ip      string
+}
+
+func newLoginKeys(login string, role entity.Role, ip string) loginKeys {
+	k := loginKeys{account: "account:" + string(role) + ":" + login}
+	if ip != "" {
+		k.ip = "ip:" + ip
+	}
+
+	return k
+}
+
+func (k loginKeys) all() []string {
+	if k.ip == "" {
+		return []string{k.account}
+	}
+
+	return []string{k.account, k.ip}
+}
+
+// checkLoginAllowed fails with a LockoutError while either the account or
+// the client address is backing off.
+func (s *PatientService) checkLoginAllowed(ctx context.Context, keys loginKeys) error {
+	attempts, err := s.repo.LoginAttempts(ctx, keys.all())
+	if err != nil {
+		return fmt.Errorf("login attempts: %w", err)
+	}
+
+	now := time.Now()
+
+	var retryAfter time.Duration
+	for _, a := range attempts {
+		if a.LockedUntil != nil && a.LockedUntil.After(now) && a.LockedUntil.Sub(now) > retryAfter {
+			retryAfter = a.LockedUntil.Sub(now)
+		}
+	}
+
+	if retryAfter > 0 {
+		return &LockoutError{RetryAfter: retryAfter}
+	}
+
+	return nil
+}
+
+func (s *PatientService) recordLoginFailure(ctx context.Context, keys loginKeys) error {
+	err := s.recordFailure(ctx, keys.account, s.loginThrottle.FreeAttempts, s.loginThrottle.LockoutThreshold)
+	if err != nil {
+		return err
+	}
+
+	if keys.ip == "" {
+		return nil
+	}
+
+	return s.recordFailure(ctx, keys.ip, s.loginThrottle.IPFreeAttempts, s.loginThrottle.IPLockoutThreshold)
+}
+
+func (s *PatientService) recordFailure(ctx context.Context, key string, free, threshold int) error {
+	now := time.Now()
+
+	failures, err := s.repo.RecordLoginFailure(ctx, key, now, now.Add(-s.loginThrottle.Window))
+	if err != nil {
+		return fmt.Errorf("record login failure: %w", err)
+	}
+
+	delay := s.loginDelay(failures, free, threshold)
+	if delay == 0 {
+		return nil
+	}
+
+	err = s.repo.LockLogin(ctx, key, now.Add(delay))
+	if err != nil {
+		return fmt.Errorf("lock login: %w", err)
+	}
+
+	return nil
+}
+
+// loginDelay doubles the wait with every failure past the free ones and
+// switches to the full lockout once the threshold is reached.
+func (s *PatientService) loginDelay(failures, free, threshold int) time.Duration {
+	switch {
+	case failures >= threshold:
+		return s.loginThrottle.LockoutDuration
+	case failures <= free:
+		return 0
+	}
+
+	delay := s.loginThrottle.BaseDelay
+	for i := free + 1; i < failures && delay < s.loginThrottle.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > s.loginThrottle.MaxDelay {
+		return s.loginThrottle.MaxDelay
+	}
+
+	return delay
+}
+
+// UnlockAccount clears the failed attempts of an account so that its owner
+// can log in again right away.
+func (s *PatientService) UnlockAccount(ctx context.Context, req entity.UnlockRequest) error {
+	if req.Role == "" {
+		req.Role = entity.RolePatient
+	}
+
+	_, err := s.userIDByLogin(ctx, req.Login, req.Role)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", req.Role, req.Login, err)
+	}
+
+	return s.repo.DeleteLoginAttempts(ctx, newLoginKeys(req.Login, req.Role, "").account)
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// mergePatch applies an RFC 7396 JSON merge patch to current and decodes the
+// result into a fresh value, so members removed by the patch end up zeroed.
+func mergePatch[T any](current T, patch []byte) (T, error) {
+	var result T
+
+	var p any
+	err := json.Unmarshal(patch, &p)
+	if err != nil {
+		return result, fmt.Errorf("%w: malformed merge patch: %v", ErrInvalid, err)
+	}
+
+	doc, err := json.Marshal(current)
+	if err != nil {
+		return result, err
+	}
+
+	var target any
+	err = json.Unmarshal(doc, &target)
+	if err != nil {
+		return result, err
+	}
+
+	merged, err := json.Marshal(applyMergePatch(target, p))
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(merged, &result)
+	if err != nil {
+		return result, fmt.Errorf("%w: patched document: %v", ErrInvalid, err)
+	}
+
+	return result, nil
+}
+
+// applyMergePatch is the MergePatch function from RFC 7396, section 2.
+func applyMergePatch(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+			continue
+		}
+
+		t[name] = applyMergePatch(t[name], value)
+	}
+
+	return t
+}
@@ -0,0 +1,25 @@
+package service
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+// Notifier delivers messages to users outside of the API, e.g. by e-mail
+// or SMS.
+type Notifier interface {
+	SendPasswordReset(ctx context.Context, role entity.Role, login, token string, expiredAt time.Time) error
+}
+
+// LogNotifier writes notifications to the log instead of delivering them.
+// It is meant for development and tests.
+type LogNotifier struct{}
+
+func (LogNotifier) SendPasswordReset(_ context.Context, role entity.Role, login, token string, expiredAt time.Time) error {
+	log.Printf("password reset for %s %s: token %s, valid until %s", role, login, token, expiredAt.Format(time.RFC3339))
+
+	return nil
+}
@@ -0,0 +1,488 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+const (
+	oidcAlgorithm = "RS256"
+	// oidcKeysRefreshInterval limits how often an unknown kid makes us fetch
+	// the provider's keys again, so forged tokens cannot flood it.
+	oidcKeysRefreshInterval = time.Minute
+	maxOIDCResponseSize     = 1 << 20
+)
+
+// oidcMFAMethods are the amr values that show the provider checked more
+// than a password (RFC 8176).
+var oidcMFAMethods = []string{"mfa", "otp", "hwk"}
+
+// OIDCProvider talks to an OpenID Connect provider for the authorization code
+// flow with PKCE. The discovery document and signing keys are fetched on
+// first use and cached.
+type OIDCProvider struct {
+	c      OIDCOptions
+	client *http.Client
+
+	mu            sync.Mutex
+	meta          *oidcMetadata
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcJWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+type oidcTokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// idTokenClaims are the ID token claims we check. The audience may be a
+// string or a list, and the roles claim is looked up by name in Raw.
+type idTokenClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"`
+	AuthorizedParty   string          `json:"azp"`
+	IssuedAt          int64           `json:"iat"`
+	ExpiresAt         int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	Name              string          `json:"name"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+	AMR               []string        `json:"amr"`
+
+	Raw map[string]json.RawMessage `json:"-"`
+}
+
+func NewOIDCProvider(c OIDCOptions, client *http.Client) *OIDCProvider {
+	return &OIDCProvider{c: c, client: client}
+}
+
+// AuthCodeURL returns the provider URL to send the browser to. The PKCE
+// challenge is derived from verifier, which must be kept for Exchange.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(meta.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("oidc authorization endpoint: %w", err)
+	}
+
+	scopes := p.c.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid"}
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.c.ClientID)
+	q.Set("redirect_uri", p.c.RedirectURL)
+	q.Set("scope", strings.Join(scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange redeems an authorization code and returns the identity from the
+// verified ID token. Anything wrong with the code or the token is reported
+// as ErrUnauthorized.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, verifier, nonce string) (entity.OIDCIdentity, error) {
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return entity.OIDCIdentity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.c.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.c.ClientID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return entity.OIDCIdentity{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.c.ClientID), url.QueryEscape(p.c.ClientSecret))
+	}
+
+	var tokens oidcTokenResponse
+
+	status, err := p.do(req, &tokens)
+	if err != nil {
+		return entity.OIDCIdentity{}, fmt.Errorf("oidc token request: %w", err)
+	}
+
+	if status != http.StatusOK || tokens.IDToken == "" {
+		msg := tokens.Error
+		if tokens.ErrorDescription != "" {
+			msg += ": " + tokens.ErrorDescription
+		}
+
+		return entity.OIDCIdentity{}, fmt.Errorf("%w: code exchange failed with status %d %s", ErrUnauthorized, status, msg)
+	}
+
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken, meta.Issuer, nonce)
+	if err != nil {
+		return entity.OIDCIdentity{}, fmt.Errorf("%w: id token: %v", ErrUnauthorized, err)
+	}
+
+	return p.identity(claims), nil
+}
+
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, token, issuer, nonce string) (idTokenClaims, error) {
+	var claims idTokenClaims
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed token")
+	}
+
+	rawHeader, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, fmt.Errorf("malformed header: %w", err)
+	}
+
+	var header jwtHeader
+	err = json.Unmarshal(rawHeader, &header)
+	if err != nil {
+		return claims, fmt.Errorf("malformed header: %w", err)
+	}
+
+	if header.Algorithm != oidcAlgorithm {
+		return claims, fmt.Errorf("unexpected algorithm %q", header.Algorithm)
+	}
+
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return claims, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, fmt.Errorf("malformed signature: %w", err)
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+
+	err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+	if err != nil {
+		return claims, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	err = json.Unmarshal(payload, &claims)
+	if err == nil {
+		err = json.Unmarshal(payload, &claims.Raw)
+	}
+	if err != nil {
+		return claims, fmt.Errorf("malformed payload: %w", err)
+	}
+
+	audience, err := claims.audience()
+	if err != nil {
+		return claims, err
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != issuer:
+		return claims, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	case !containsString(audience, p.c.ClientID):
+		return claims, fmt.Errorf("token is not meant for client %q", p.c.ClientID)
+	case len(audience) > 1 && claims.AuthorizedParty != p.c.ClientID:
+		return claims, fmt.Errorf("unexpected authorized party %q", claims.AuthorizedParty)
+	case now.Add(-jwtClockLeeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return claims, errors.New("token expired")
+	case now.Add(jwtClockLeeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return claims, errors.New("token issued in the future")
+	case claims.Nonce != nonce:
+		return claims, errors.New("nonce mismatch")
+	case claims.Subject == "":
+		return claims, errors.New("missing subject")
+	}
+
+	return claims, nil
+}
+
+func (c idTokenClaims) audience() ([]string, error) {
+	var one string
+	if json.Unmarshal(c.Audience, &one) == nil {
+		return []string{one}, nil
+	}
+
+	var many []string
+	if json.Unmarshal(c.Audience, &many) == nil {
+		return many, nil
+	}
+
+	return nil, errors.New("malformed audience")
+}
+
+func (p *OIDCProvider) identity(claims idTokenClaims) entity.OIDCIdentity {
+	id := entity.OIDCIdentity{
+		Subject:  claims.Subject,
+		Login:    claims.PreferredUsername,
+		FullName: claims.Name,
+		Roles:    rolesClaim(claims.Raw, p.c.RolesClaim),
+	}
+
+	if id.Login == "" {
+		id.Login = claims.Email
+	}
+
+	for _, m := range claims.AMR {
+		id.MFA = id.MFA || containsString(oidcMFAMethods, m)
+	}
+
+	return id
+}
+
+// rolesClaim reads a list of strings from claims. Dots in name walk into
+// nested objects, e.g. "realm_access.roles".
+func rolesClaim(claims map[string]json.RawMessage, name string) []string {
+	path := strings.Split(name, ".")
+
+	for _, key := range path[:len(path)-1] {
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(claims[key], &nested) != nil {
+			return nil
+		}
+
+		claims = nested
+	}
+
+	var roles []string
+	if json.Unmarshal(claims[path[len(path)-1]], &roles) != nil {
+		return nil
+	}
+
+	return roles
+}
+
+// metadata returns the discovery document. The lock is not held while the
+// provider is asked, so a slow provider cannot stall logins that already
+// have what they need; concurrent first calls may both fetch it.
+func (p *OIDCProvider) metadata(ctx context.Context) (*oidcMetadata, error) {
+	p.mu.Lock()
+	meta := p.meta
+	p.mu.Unlock()
+
+	if meta != nil {
+		return meta, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.c.Issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	meta = &oidcMetadata{}
+
+	status, err := p.do(req, meta)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	switch {
+	case status != http.StatusOK:
+		return nil, fmt.Errorf("oidc discovery: unexpected status %d", status)
+	case meta.Issuer != p.c.Issuer:
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", meta.Issuer, p.c.Issuer)
+	case meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "":
+		return nil, errors.New("oidc discovery: incomplete provider metadata")
+	}
+
+	p.mu.Lock()
+	p.meta = meta
+	p.mu.Unlock()
+
+	return meta, nil
+}
+
+// key returns the signing key kid, fetching the key set again if the
+// provider rotated its keys since we last looked. Only one caller refetches
+// at a time and none of them holds the lock while waiting for the provider.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	lastFetch := p.keysFetchedAt
+	refetch := !ok && time.Since(lastFetch) >= oidcKeysRefreshInterval
+	if refetch {
+		p.keysFetchedAt = time.Now()
+	}
+	jwksURI := p.meta.JWKSURI
+	p.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+
+	if !refetch {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	keys, err := p.fetchKeys(ctx, jwksURI)
+	if err != nil {
+		// Let the next login try again instead of waiting out the interval.
+		p.mu.Lock()
+		p.keysFetchedAt = lastFetch
+		p.mu.Unlock()
+
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	return key, nil
+}
+
+// fetchKeys downloads the provider's key set. Keys we cannot use, whether
+// of another type or malformed, are skipped so that one bad key does not
+// take the usable ones down with it.
+func (p *OIDCProvider) fetchKeys(ctx context.Context, jwksURI string) (map[string]*rsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+
+	status, err := p.do(req, &set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("oidc keys: unexpected status %d", status)
+	}
+
+	keys := make(map[string]*rsa.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.KeyType != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Algorithm != "" && k.Algorithm != oidcAlgorithm) {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("oidc: skipping key %q: %v", k.KeyID, err)
+			continue
+		}
+
+		keys[k.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+func (k oidcJWK) publicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("malformed modulus: %w", err)
+	}
+
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("malformed exponent: %w", err)
+	}
+
+	exponent := new(big.Int).SetBytes(e)
+	if len(n) < 256 || !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("unsupported key size or exponent")
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// do sends req and decodes the JSON body into v whatever the status, since
+// error responses carry details as JSON too.
+func (p *OIDCProvider) do(req *http.Request, v any) (int, error) {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOIDCResponseSize))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+
+	if json.Unmarshal(body, v) != nil && resp.StatusCode == http.StatusOK {
+		return resp.StatusCode, errors.New("malformed response")
+	}
+
+	return resp.StatusCode, nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package service
+
+import "time"
+
+// Options are the settings of PatientService. They are plain values so that
+// the service does not depend on how the application reads its
+// configuration.
+type Options struct {
+	Session       SessionOptions
+	PasswordReset PasswordResetOptions
+	LoginThrottle LoginThrottleOptions
+	JWT           JWTOptions
+	TOTP          TOTPOptions
+	OIDC          OIDCOptions
+}
+
+type SessionOptions struct {
+	TTL         time.Duration
+	MaxLifetime time.Duration
+	Sliding     bool
+}
+
+type PasswordResetOptions struct {
+	TTL time.Duration
+}
+
+type LoginThrottleOptions struct {
+	Window             time.Duration
+	FreeAttempts       int
+	LockoutThreshold   int
+	IPFreeAttempts     int
+	IPLockoutThreshold int
+	BaseDelay          time.Duration
+	MaxDelay           time.Duration
+	LockoutDuration    time.Duration
+}
+
+// JWTOptions configure the HS256 access tokens of bearer clients. Keys maps
+// key ids to secrets; all of them verify tokens and SigningKeyID signs new
+// ones. Bearer tokens are off while Keys is empty.
+type JWTOptions struct {
+	Issuer       string
+	Audience     string
+	AccessTTL    time.Duration
+	Keys         map[string]string
+	SigningKeyID string
+}
+
+type TOTPOptions struct {
+	Issuer             string
+	PendingTTL         time.Duration
+	RequiredForDoctors bool
+}
+
+// OIDCOptions enable single sign-on for staff; it is off while Issuer is
+// empty.
+type OIDCOptions struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	RolesClaim   string
+	DoctorRole   string
+	AdminRole    string
+	LoginTTL     time.Duration
+	HTTPTimeout  time.Duration
+}
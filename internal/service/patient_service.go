@@ -2,9 +2,15 @@ package service
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"medical-card/internal/entity"
 
@@ -13,49 +19,133 @@ import (
 )
 
 type PatientRepository interface {
+	// WithTx runs fn against a repository bound to a single transaction,
+	// committing if fn returns nil and rolling back otherwise. Calls nested
+	// inside fn join the outer transaction. Transactions run at READ
+	// COMMITTED, so a check followed by a write must lock the rows it
+	// checked or leave the check to a constraint.
+	WithTx(ctx context.Context, fn func(repo PatientRepository) error) error
+
 	PatientByPassportNumber(ctx context.Context, passNumber string) (entity.Patient, error)
 	PatientByLogin(ctx context.Context, login string) (entity.Patient, error)
 	PatientByID(ctx context.Context, id int64) (entity.Patient, error)
+	LockPatient(ctx context.Context, id int64) error
 	CreatePatient(ctx context.Context, p entity.Patient) (entity.Patient, error)
-	Patients(ctx context.Context) ([]entity.Patient, error)
+	Patients(ctx context.Context, q entity.PatientQuery) ([]entity.Patient, error)
+	SearchPatients(ctx context.Context, query string, limit int) ([]entity.PatientSearchResult, error)
 	UpdatePatient(ctx context.Context, id int64, p entity.Patient) error
-	DeletePatient(ctx context.Context, id int64) error
+	DeletePatient(ctx context.Context, id, version int64) error
 
 	CreateCard(ctx context.Context, c entity.Card) (entity.Card, error)
 	CardByID(ctx context.Context, id int64) (entity.Card, error)
+	CardByPatientID(ctx context.Context, patientID int64) (entity.Card, error)
+	Cards(ctx context.Context, f entity.CardFilter, limit, offset int) ([]entity.Card, error)
 	UpdateCard(ctx context.Context, id int64, c entity.Card) error
+	DeleteCard(ctx context.Context, id, version int64) error
+
+	CreateConsultation(ctx context.Context, c entity.Consultation) (entity.Consultation, error)
+	ConsultationByID(ctx context.Context, id int64) (entity.Consultation, error)
+	CardConsultations(ctx context.Context, cardID int64, limit, offset int) ([]entity.Consultation, error)
+	UpdateConsultation(ctx context.Context, id int64, c entity.Consultation) error
+
+	CreateDoctor(ctx context.Context, d entity.Doctor) (entity.Doctor, error)
+	DoctorByID(ctx context.Context, id int64) (entity.Doctor, error)
+	DoctorByLogin(ctx context.Context, login string) (entity.Doctor, error)
+	HasDoctors(ctx context.Context) (bool, error)
 
-	Login(ctx context.Context, sess entity.Session) error
+	CreateSession(ctx context.Context, sess entity.Session) error
 	SessionByID(ctx context.Context, id string) (entity.Session, error)
-}
+	SessionByRefreshToken(ctx context.Context, hash string) (entity.Session, error)
+	SessionByTokenID(ctx context.Context, tokenID string) (entity.Session, error)
+	UpdateSessionRefreshToken(ctx context.Context, id uuid.UUID, tokenID, oldHash, newHash string) error
+	UpdateSessionExpiry(ctx context.Context, id uuid.UUID, expiredAt time.Time) error
+	DeleteSession(ctx context.Context, id string) error
+	DeleteUserSessions(ctx context.Context, userID int64, role entity.Role) error
+	DeleteExpiredSessions(ctx context.Context, before time.Time, limit int) (int64, error)
 
-type PatientService struct {
-	repo PatientRepository
-}
+	UpdatePassword(ctx context.Context, userID int64, role entity.Role, hash string) error
+	CreatePasswordReset(ctx context.Context, pr entity.PasswordReset) error
+	UsePasswordReset(ctx context.Context, tokenHash string, now time.Time) (entity.PasswordReset, error)
 
-func NewPatientService(repo PatientRepository) *PatientService {
-	return &PatientService{repo: repo}
+	LoginAttempts(ctx context.Context, keys []string) ([]entity.LoginAttempt, error)
+	RecordLoginFailure(ctx context.Context, key string, now, windowStart time.Time) (int, error)
+	LockLogin(ctx context.Context, key string, until time.Time) error
+	DeleteLoginAttempts(ctx context.Context, key string) error
+
+	CreateAPIKey(ctx context.Context, k entity.APIKey) (entity.APIKey, error)
+	APIKeys(ctx context.Context) ([]entity.APIKey, error)
+	APIKeyByID(ctx context.Context, id int64) (entity.APIKey, error)
+	APIKeyByHash(ctx context.Context, hash string) (entity.APIKey, error)
+	UpdateAPIKeyHash(ctx context.Context, id int64, prefix, hash string) error
+	RevokeAPIKey(ctx context.Context, id int64, now time.Time) error
+	TouchAPIKey(ctx context.Context, id int64, now time.Time) error
+
+	TOTPByUser(ctx context.Context, userID int64, role entity.Role) (entity.TOTP, error)
+	SaveTOTP(ctx context.Context, t entity.TOTP) error
+	EnableTOTP(ctx context.Context, userID int64, role entity.Role, enabledAt time.Time) error
+	UseTOTPStep(ctx context.Context, userID int64, role entity.Role, step int64) error
+	DeleteTOTP(ctx context.Context, userID int64, role entity.Role) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int64, role entity.Role, hashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int64, role entity.Role, hash string, now time.Time) error
+
+	DoctorByOIDCSubject(ctx context.Context, subject string) (entity.Doctor, error)
+	UpdateDoctorIdentity(ctx context.Context, d entity.Doctor) error
+	CreateOIDCLogin(ctx context.Context, l entity.OIDCLogin) error
+	UseOIDCLogin(ctx context.Context, stateHash string, now time.Time) (entity.OIDCLogin, error)
 }
 
-// Patient methods
+const (
+	minSearchQueryLength = 2
+	tokenSize            = 32
 
-func (s *PatientService) AddPatient(ctx context.Context, p entity.Patient) (entity.Patient, error) {
-	_, err := s.repo.PatientByPassportNumber(ctx, p.PassportNumber)
-	if err == nil {
-		return p, fmt.Errorf("patient with passport %q: %w", p.PassportNumber, ErrAlreadyExists)
-	}
+	cursorTimeLayout = time.RFC3339Nano
+	cursorDateLayout = "2006-01-02"
+)
+
+type PatientService struct {
+	repo          PatientRepository
+	notifier      Notifier
+	session       SessionOptions
+	passwordReset PasswordResetOptions
+	loginThrottle LoginThrottleOptions
+	jwt           JWTOptions
+	totp          TOTPOptions
+	oidcConfig    OIDCOptions
+	oidc          *OIDCProvider
+}
 
-	if !errors.Is(err, ErrNotFound) {
-		return p, fmt.Errorf("patient with passport %q: %w", p.PassportNumber, err)
+// NewPatientService fails if the options would only break at the first
+// request that needs them, such as an unusable JWT signing key.
+func NewPatientService(repo PatientRepository, opts Options, notifier Notifier) (*PatientService, error) {
+	err := validateSessionOptions(opts.Session)
+	if err != nil {
+		return nil, err
 	}
 
-	_, err = s.repo.PatientByLogin(ctx, p.Login)
-	if err == nil {
-		return p, fmt.Errorf("patient with login %q: %w", p.Login, ErrAlreadyExists)
+	err = validateJWTOptions(opts.JWT)
+	if err != nil {
+		return nil, err
 	}
 
-	if !errors.Is(err, ErrNotFound) {
-		return p, fmt.Errorf("patient with login %q: %w", p.Login, err)
+	return &PatientService{
+		repo:          repo,
+		notifier:      notifier,
+		session:       opts.Session,
+		passwordReset: opts.PasswordReset,
+		loginThrottle: opts.LoginThrottle,
+		jwt:           opts.JWT,
+		totp:          opts.TOTP,
+		oidcConfig:    opts.OIDC,
+		oidc:          newOIDCProvider(opts.OIDC),
+	}, nil
+}
+
+// Patient methods
+
+func (s *PatientService) AddPatient(ctx context.Context, p entity.Patient) (entity.Patient, error) {
+	err := validatePatient(p, true)
+	if err != nil {
+		return p, err
 	}
 
 	p.Password, err = s.hashPassword(p.Password)
@@ -73,75 +163,404 @@ func (s *PatientService) AddPatient(ctx context.Context, p entity.Patient) (enti
 	return p, nil
 }
 
-func (s *PatientService) Patients(ctx context.Context) ([]entity.Patient, error) {
-	return s.repo.Patients(ctx)
+// Patients returns a page of patients and the cursor of the next page, which
+// is nil on the last page.
+func (s *PatientService) Patients(ctx context.Context, q entity.PatientQuery) ([]entity.Patient, *entity.PatientCursor, error) {
+	if q.Sort == "" {
+		q.Sort = entity.PatientSortCreatedAt
+	}
+
+	if q.After != nil && (q.After.Sort != q.Sort || q.After.Desc != q.Desc) {
+		return nil, nil, fmt.Errorf("%w: cursor does not match the requested sort order", ErrInvalid)
+	}
+
+	if q.After != nil && !validCursorValue(q.After) {
+		return nil, nil, fmt.Errorf("%w: malformed cursor", ErrInvalid)
+	}
+
+	limit := q.Limit
+	q.Limit++
+
+	patients, err := s.repo.Patients(ctx, q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(patients) <= limit {
+		return patients, nil, nil
+	}
+
+	patients = patients[:limit]
+	last := patients[limit-1]
+
+	next := &entity.PatientCursor{
+		Sort: q.Sort,
+		Desc: q.Desc,
+		ID:   last.ID,
+	}
+
+	switch q.Sort {
+	case entity.PatientSortFullName:
+		next.Value = last.FullName
+	case entity.PatientSortCreatedAt:
+		next.Value = last.CreatedAt.Format(cursorTimeLayout)
+	case entity.PatientSortDateOfBorn:
+		next.Value = last.DateOfBorn.Format(cursorDateLayout)
+	}
+
+	return patients, next, nil
+}
+
+// validCursorValue checks that a cursor, which clients can tamper with,
+// holds a value of the type of its sort column before it reaches the query.
+func validCursorValue(c *entity.PatientCursor) bool {
+	switch c.Sort {
+	case entity.PatientSortFullName:
+		return utf8.ValidString(c.Value) && !strings.ContainsRune(c.Value, 0)
+	case entity.PatientSortCreatedAt:
+		_, err := time.Parse(cursorTimeLayout, c.Value)
+		return err == nil
+	case entity.PatientSortDateOfBorn:
+		_, err := time.Parse(cursorDateLayout, c.Value)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+func (s *PatientService) SearchPatients(ctx context.Context, query string, limit int) ([]entity.PatientSearchResult, error) {
+	query = strings.TrimSpace(query)
+	if len([]rune(query)) < minSearchQueryLength {
+		return nil, fmt.Errorf("%w: search query must be at least %d characters", ErrInvalid, minSearchQueryLength)
+	}
+
+	return s.repo.SearchPatients(ctx, query, limit)
 }
 
 func (s *PatientService) PatientByPassportNumber(ctx context.Context, passNumber string) (entity.Patient, error) {
 	return s.repo.PatientByPassportNumber(ctx, passNumber)
 }
 
+func (s *PatientService) PatientByID(ctx context.Context, id int64) (entity.Patient, error) {
+	return s.repo.PatientByID(ctx, id)
+}
+
 func (s *PatientService) PatientByLogin(ctx context.Context, login string) (entity.Patient, error) {
 	return s.repo.PatientByLogin(ctx, login)
 }
 
-func (s *PatientService) UpdatePatient(ctx context.Context, id int64, p entity.Patient) error {
-	_, err := s.repo.PatientByID(ctx, id)
+// UpdatePatient overwrites the patient if it is still at p.Version.
+func (s *PatientService) UpdatePatient(ctx context.Context, id int64, p entity.Patient) (entity.Patient, error) {
+	err := validatePatient(p, false)
 	if err != nil {
-		return fmt.Errorf("patient with id %d: %w", id, err)
+		return p, err
 	}
 
-	p.UpdatedAt = time.Now()
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		current, err := tx.repo.PatientByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("patient with id %d: %w", id, err)
+		}
+
+		p.ID = current.ID
+		p.Card = current.Card
+		p.Password = ""
+		p.CreatedAt = current.CreatedAt
+		p.UpdatedAt = time.Now()
+
+		err = tx.repo.UpdatePatient(ctx, id, p)
+		if err != nil {
+			return err
+		}
+
+		p.Version++
+
+		return nil
+	})
+
+	return p, err
+}
+
+// PatchPatient applies an RFC 7396 merge patch to the stored patient.
+// Identity, card, password and timestamps are managed by the service and
+// keep their stored values whatever the patch says.
+func (s *PatientService) PatchPatient(ctx context.Context, id, version int64, patch []byte) (entity.Patient, error) {
+	var p entity.Patient
+
+	err := s.withTx(ctx, func(tx *PatientService) error {
+		current, err := tx.repo.PatientByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("patient with id %d: %w", id, err)
+		}
+
+		p, err = mergePatch(current, patch)
+		if err != nil {
+			return err
+		}
 
-	err = s.repo.UpdatePatient(ctx, id, p)
+		p.ID = current.ID
+		p.Card = current.Card
+		p.Password = ""
+		p.EncryptedPassword = current.EncryptedPassword
+		p.CreatedAt = current.CreatedAt
+		p.Version = version
+
+		err = validatePatient(p, false)
+		if err != nil {
+			return err
+		}
+
+		p.UpdatedAt = time.Now()
+
+		err = tx.repo.UpdatePatient(ctx, id, p)
+		if err != nil {
+			return err
+		}
+
+		p.Version++
+
+		return nil
+	})
+
+	return p, err
+}
+
+func (s *PatientService) DeletePatient(ctx context.Context, id, version int64) error {
+	return s.withTx(ctx, func(tx *PatientService) error {
+		_, err := tx.repo.PatientByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("patient with id %d: %w", id, err)
+		}
+
+		card, err := tx.repo.CardByPatientID(ctx, id)
+		switch {
+		case err == nil:
+			err = tx.repo.DeleteCard(ctx, card.ID, card.Version)
+			if err != nil {
+				return fmt.Errorf("delete card %d: %w", card.ID, err)
+			}
+		case !errors.Is(err, ErrNotFound):
+			return fmt.Errorf("card of patient %d: %w", id, err)
+		}
+
+		err = tx.repo.DeleteUserSessions(ctx, id, entity.RolePatient)
+		if err != nil {
+			return fmt.Errorf("delete sessions of patient %d: %w", id, err)
+		}
+
+		return tx.repo.DeletePatient(ctx, id, version)
+	})
+}
+
+// Card methods
+
+func (s *PatientService) AddCard(ctx context.Context, c entity.Card) (entity.Card, error) {
+	err := validateCard(c)
 	if err != nil {
-		return err
+		return c, err
 	}
 
-	return nil
+	c.CreatedAt = time.Now()
+	c.UpdatedAt = c.CreatedAt
+
+	// Locking the patient serializes concurrent card creation for them, so
+	// the check below cannot be raced.
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		err := tx.repo.LockPatient(ctx, c.PatientID)
+		if err != nil {
+			return fmt.Errorf("patient with id %d: %w", c.PatientID, err)
+		}
+
+		_, err = tx.repo.CardByPatientID(ctx, c.PatientID)
+		if err == nil {
+			return fmt.Errorf("card of patient %d: %w", c.PatientID, ErrAlreadyExists)
+		}
+
+		if !errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("card of patient %d: %w", c.PatientID, err)
+		}
+
+		c, err = tx.repo.CreateCard(ctx, c)
+		if err != nil {
+			return fmt.Errorf("create card: %w", err)
+		}
+
+		return nil
+	})
+
+	return c, err
 }
 
-func (s *PatientService) DeletePatient(ctx context.Context, id int64) error {
-	_, err := s.repo.PatientByID(ctx, id)
+func (s *PatientService) CardByID(ctx context.Context, id int64) (entity.Card, error) {
+	return s.repo.CardByID(ctx, id)
+}
+
+// UpdateCard replaces the stored card. Like PatchCard it refuses to move the
+// card to another patient.
+func (s *PatientService) UpdateCard(ctx context.Context, id int64, c entity.Card) (entity.Card, error) {
+	err := validateCard(c)
 	if err != nil {
-		return fmt.Errorf("patient with id %d: %w", id, err)
+		return c, err
 	}
 
-	return s.repo.DeletePatient(ctx, id)
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		current, err := tx.repo.CardByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("card with id %d: %w", id, err)
+		}
+
+		if c.PatientID != current.PatientID {
+			return &ValidationError{Fields: []FieldError{{Field: "patient_id", Message: "cannot be changed"}}}
+		}
+
+		c.ID = current.ID
+		c.CreatedAt = current.CreatedAt
+		c.UpdatedAt = time.Now()
+
+		err = tx.repo.UpdateCard(ctx, id, c)
+		if err != nil {
+			return err
+		}
+
+		c.Version++
+
+		return nil
+	})
+
+	return c, err
 }
 
-// Card methods
+// PatchCard applies an RFC 7396 merge patch to the stored card. A card
+// stays with its patient, so a patch that changes patient_id is rejected.
+func (s *PatientService) PatchCard(ctx context.Context, id, version int64, patch []byte) (entity.Card, error) {
+	var c entity.Card
 
-func (s *PatientService) AddCard(ctx context.Context, c entity.Card) (entity.Card, error) {
-	_, err := s.repo.PatientByID(ctx, c.PatientID)
-	if err == nil {
-		return c, fmt.Errorf("patient with id %d: %w", c.PatientID, ErrAlreadyExists)
+	err := s.withTx(ctx, func(tx *PatientService) error {
+		current, err := tx.repo.CardByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("card with id %d: %w", id, err)
+		}
+
+		c, err = mergePatch(current, patch)
+		if err != nil {
+			return err
+		}
+
+		if c.PatientID != current.PatientID {
+			return &ValidationError{Fields: []FieldError{{Field: "patient_id", Message: "cannot be changed"}}}
+		}
+
+		c.ID = current.ID
+		c.CreatedAt = current.CreatedAt
+		c.Version = version
+
+		err = validateCard(c)
+		if err != nil {
+			return err
+		}
+
+		c.UpdatedAt = time.Now()
+
+		err = tx.repo.UpdateCard(ctx, id, c)
+		if err != nil {
+			return err
+		}
+
+		c.Version++
+
+		return nil
+	})
+
+	return c, err
+}
+
+func (s *PatientService) CardByPatientID(ctx context.Context, patientID int64) (entity.Card, error) {
+	return s.repo.CardByPatientID(ctx, patientID)
+}
+
+func (s *PatientService) Cards(ctx context.Context, f entity.CardFilter, limit, offset int) ([]entity.Card, error) {
+	return s.repo.Cards(ctx, f, limit, offset)
+}
+
+func (s *PatientService) DeleteCard(ctx context.Context, id, version int64) error {
+	return s.withTx(ctx, func(tx *PatientService) error {
+		_, err := tx.repo.CardByID(ctx, id)
+		if err != nil {
+			return fmt.Errorf("card with id %d: %w", id, err)
+		}
+
+		return tx.repo.DeleteCard(ctx, id, version)
+	})
+}
+
+// Consultation methods
+
+func (s *PatientService) AddConsultation(ctx context.Context, c entity.Consultation) (entity.Consultation, error) {
+	err := validateConsultation(c)
+	if err != nil {
+		return c, err
 	}
 
-	if !errors.Is(err, ErrNotFound) {
-		return c, fmt.Errorf("patient with id  %d: %w", c.PatientID, err)
+	_, err = s.repo.CardByID(ctx, c.CardID)
+	if err != nil {
+		return c, fmt.Errorf("card with id %d: %w", c.CardID, err)
 	}
 
 	c.CreatedAt = time.Now()
 	c.UpdatedAt = c.CreatedAt
 
-	card, err := s.repo.CreateCard(ctx, c)
+	c, err = s.repo.CreateConsultation(ctx, c)
 	if err != nil {
-		return card, fmt.Errorf("create card: %w", err)
+		return c, fmt.Errorf("create consultation: %w", err)
 	}
 
-	return card, nil
+	return c, nil
 }
 
-func (s *PatientService) UpdateCard(ctx context.Context, id int64, c entity.Card) error {
-	_, err := s.repo.CardByID(ctx, id)
+func (s *PatientService) CardConsultations(ctx context.Context, cardID int64, limit, offset int) ([]entity.Consultation, error) {
+	_, err := s.repo.CardByID(ctx, cardID)
 	if err != nil {
-		return fmt.Errorf("card with id %d: %w", id, err)
+		return nil, fmt.Errorf("card with id %d: %w", cardID, err)
 	}
 
-	c.UpdatedAt = time.Now()
+	return s.repo.CardConsultations(ctx, cardID, limit, offset)
+}
+
+func (s *PatientService) UpdateConsultation(ctx context.Context, cardID, id int64, c entity.Consultation) (entity.Consultation, error) {
+	err := validateConsultation(c)
+	if err != nil {
+		return c, err
+	}
 
-	return s.repo.UpdateCard(ctx, id, c)
+	current, err := s.repo.ConsultationByID(ctx, id)
+	if err != nil {
+		return c, fmt.Errorf("consultation with id %d: %w", id, err)
+	}
+
+	if current.CardID != cardID {
+		return c, fmt.Errorf("consultation with id %d: %w", id, ErrNotFound)
+	}
+
+	current.Complaints = c.Complaints
+	current.Descriptions = c.Descriptions
+	current.Recommendations = c.Recommendations
+	current.UpdatedAt = time.Now()
+
+	err = s.repo.UpdateConsultation(ctx, id, current)
+	if err != nil {
+		return c, err
+	}
+
+	return current, nil
+}
+
+func (s *PatientService) withTx(ctx context.Context, fn func(tx *PatientService) error) error {
+	return s.repo.WithTx(ctx, func(repo PatientRepository) error {
+		tx := *s
+		tx.repo = repo
+
+		return fn(&tx)
+	})
 }
 
 func (s *PatientService) hashPassword(password string) (string, error) {
@@ -153,17 +572,218 @@ func (s *PatientService) hashPassword(password string) (string, error) {
 	return string(passwordHash), nil
 }
 
+// Doctor methods
+
+func (s *PatientService) AddDoctor(ctx context.Context, d entity.Doctor) (entity.Doctor, error) {
+	err := validateDoctor(d)
+	if err != nil {
+		return d, err
+	}
+
+	d.Password, err = s.hashPassword(d.Password)
+	if err != nil {
+		return d, err
+	}
+	d.CreatedAt = time.Now()
+	d.UpdatedAt = d.CreatedAt
+
+	d, err = s.repo.CreateDoctor(ctx, d)
+	if err != nil {
+		return d, fmt.Errorf("create doctor: %w", err)
+	}
+
+	return d, nil
+}
+
+func (s *PatientService) DoctorByID(ctx context.Context, id int64) (entity.Doctor, error) {
+	return s.repo.DoctorByID(ctx, id)
+}
+
+// BootstrapAdmin creates d as an admin on a deployment without doctors,
+// since doctors are otherwise only created by other doctors. It does
+// nothing once any doctor exists and reports whether it created one.
+func (s *PatientService) BootstrapAdmin(ctx context.Context, d entity.Doctor) (bool, error) {
+	d.IsAdmin = true
+
+	err := validateDoctor(d)
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		exists, err := tx.repo.HasDoctors(ctx)
+		if err != nil || exists {
+			return err
+		}
+
+		_, err = tx.AddDoctor(ctx, d)
+		if err != nil {
+			return err
+		}
+
+		created = true
+
+		return nil
+	})
+	if errors.Is(err, ErrAlreadyExists) {
+		// Another instance bootstrapped the same admin first.
+		return false, nil
+	}
+
+	return created, err
+}
+
 // Session
 
-func (s *PatientService) Login(ctx context.Context, patientID int64) (entity.Session, error) {
+// Login checks the credentials and opens a session. Failures are counted
+// against both the account and the client address, which get locked out
+// with growing delays. Users with 2FA get a pending session unless the
+// credentials carry a valid one-time code as well.
+func (s *PatientService) Login(ctx context.Context, creds entity.Credentials, ip string) (entity.Session, error) {
+	if creds.Role == "" {
+		creds.Role = entity.RolePatient
+	}
+
+	keys := newLoginKeys(creds.Login, creds.Role, ip)
+
+	err := s.checkLoginAllowed(ctx, keys)
+	if err != nil {
+		return entity.Session{}, err
+	}
+
+	userID, err := s.authenticate(ctx, creds)
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			ferr := s.recordLoginFailure(ctx, keys)
+			if ferr != nil {
+				return entity.Session{}, ferr
+			}
+		}
+
+		return entity.Session{}, err
+	}
+
+	mfa, err := s.loginMFA(ctx, userID, creds.Role, creds.OTP)
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			ferr := s.recordLoginFailure(ctx, keys)
+			if ferr != nil {
+				return entity.Session{}, ferr
+			}
+		}
+
+		return entity.Session{}, err
+	}
+
+	// A pending session has not proven the second factor yet, so it must not
+	// wipe out the failures its codes are throttled by.
+	if mfa != entity.MFAPending {
+		err = s.repo.DeleteLoginAttempts(ctx, keys.account)
+		if err != nil {
+			return entity.Session{}, fmt.Errorf("reset login attempts: %w", err)
+		}
+	}
+
+	return s.createSession(ctx, userID, creds.Role, mfa)
+}
+
+func (s *PatientService) Signup(ctx context.Context, p entity.Patient) (entity.Patient, entity.Session, error) {
+	var sess entity.Session
+
+	err := s.withTx(ctx, func(tx *PatientService) error {
+		var err error
+
+		p, err = tx.AddPatient(ctx, p)
+		if err != nil {
+			return err
+		}
+
+		sess, err = tx.createSession(ctx, p.ID, entity.RolePatient, entity.MFANone)
+		if err != nil {
+			return fmt.Errorf("create session: %w", err)
+		}
+
+		return nil
+	})
+
+	return p, sess, err
+}
+
+// SessionByID returns the active session behind a session cookie. Sessions
+// of bearer clients are only reachable through their tokens.
+func (s *PatientService) SessionByID(ctx context.Context, ssid string) (entity.Session, error) {
+	session, err := s.repo.SessionByID(ctx, ssid)
+	if err != nil {
+		return entity.Session{}, err
+	}
+
+	if session.RefreshTokenHash != "" {
+		return entity.Session{}, fmt.Errorf("%w: session belongs to a bearer client", ErrUnauthorized)
+	}
+
+	if time.Now().After(session.ExpiredAt) {
+		return entity.Session{}, fmt.Errorf("%w: session expired", ErrUnauthorized)
+	}
+
+	return session, nil
+}
+
+// RenewSession slides the expiry of an active session forward once less than
+// half of its TTL is left, never past the configured maximum lifetime.
+// Sessions waiting for a second factor are never renewed.
+func (s *PatientService) RenewSession(ctx context.Context, sess entity.Session) (entity.Session, bool, error) {
+	if !s.session.Sliding || sess.MFA == entity.MFAPending || time.Until(sess.ExpiredAt) > s.session.TTL/2 {
+		return sess, false, nil
+	}
+
+	return s.extendSession(ctx, sess)
+}
+
+func (s *PatientService) RefreshSession(ctx context.Context, sess entity.Session) (entity.Session, error) {
+	sess, _, err := s.extendSession(ctx, sess)
+	return sess, err
+}
+
+func (s *PatientService) Logout(ctx context.Context, current entity.Session, ssid string) error {
+	_, err := uuid.Parse(ssid)
+	if err != nil {
+		return fmt.Errorf("session %s: %w", ssid, ErrNotFound)
+	}
+
+	sess, err := s.repo.SessionByID(ctx, ssid)
+	if err != nil {
+		return fmt.Errorf("session %s: %w", ssid, err)
+	}
+
+	if sess.UserID != current.UserID || sess.Role != current.Role {
+		return fmt.Errorf("session %s: %w", ssid, ErrNotFound)
+	}
+
+	return s.repo.DeleteSession(ctx, ssid)
+}
+
+func (s *PatientService) LogoutAll(ctx context.Context, current entity.Session) error {
+	return s.repo.DeleteUserSessions(ctx, current.UserID, current.Role)
+}
+
+func (s *PatientService) createSession(ctx context.Context, userID int64, role entity.Role, mfa entity.MFAState) (entity.Session, error) {
+	now := time.Now()
+
 	sess := entity.Session{
 		ID:        uuid.New(),
-		PatientID: patientID,
-		CreatedAt: time.Now(),
-		ExpiredAt: time.Now().Add(time.Minute * 1),
+		UserID:    userID,
+		Role:      role,
+		MFA:       mfa,
+		CreatedAt: now,
+		ExpiredAt: s.sessionExpiry(now, now),
+	}
+	if mfa == entity.MFAPending {
+		sess.ExpiredAt = now.Add(s.totp.PendingTTL)
 	}
 
-	err := s.repo.Login(ctx, sess)
+	err := s.repo.CreateSession(ctx, sess)
 	if err != nil {
 		return entity.Session{}, err
 	}
@@ -171,20 +791,281 @@ func (s *PatientService) Login(ctx context.Context, patientID int64) (entity.Ses
 	return sess, nil
 }
 
-func (s *PatientService) PatientBySessionID(ctx context.Context, ssid string) (entity.Patient, error) {
-	session, err := s.repo.SessionByID(ctx, ssid)
+func (s *PatientService) extendSession(ctx context.Context, sess entity.Session) (entity.Session, bool, error) {
+	expiredAt := s.sessionExpiry(sess.CreatedAt, time.Now())
+	if !expiredAt.After(sess.ExpiredAt) {
+		return sess, false, nil
+	}
+
+	err := s.repo.UpdateSessionExpiry(ctx, sess.ID, expiredAt)
 	if err != nil {
-		return entity.Patient{}, err
+		return sess, false, fmt.Errorf("extend session: %w", err)
 	}
 
-	if time.Now().After(session.ExpiredAt) {
-		return entity.Patient{}, fmt.Errorf("%w: session expired", ErrUnauthorized)
+	sess.ExpiredAt = expiredAt
+
+	return sess, true, nil
+}
+
+func (s *PatientService) sessionExpiry(createdAt, now time.Time) time.Time {
+	expiredAt := now.Add(s.session.TTL)
+
+	maxExpiredAt := createdAt.Add(s.session.MaxLifetime)
+	if expiredAt.After(maxExpiredAt) {
+		return maxExpiredAt
+	}
+
+	return expiredAt
+}
+
+// validateSessionOptions rejects lifetimes that would expire sessions as soon
+// as they are created or let the idle timeout outlast the hard limit.
+func validateSessionOptions(o SessionOptions) error {
+	if o.TTL <= 0 {
+		return fmt.Errorf("session ttl must be positive, got %s", o.TTL)
+	}
+
+	if o.MaxLifetime <= 0 {
+		return fmt.Errorf("session max lifetime must be positive, got %s", o.MaxLifetime)
+	}
+
+	if o.TTL > o.MaxLifetime {
+		return fmt.Errorf("session ttl %s exceeds the max lifetime %s", o.TTL, o.MaxLifetime)
 	}
 
-	patient, err := s.repo.PatientByID(ctx, session.PatientID)
+	return nil
+}
+
+func (s *PatientService) authenticate(ctx context.Context, creds entity.Credentials) (int64, error) {
+	errIncorrect := fmt.Errorf("%w: incorrect login or password", ErrUnauthorized)
+
+	switch creds.Role {
+	case entity.RolePatient:
+		p, err := s.repo.PatientByLogin(ctx, creds.Login)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return 0, errIncorrect
+			}
+
+			return 0, err
+		}
+
+		if !p.ComparePassword(creds.Password) {
+			return 0, errIncorrect
+		}
+
+		return p.ID, nil
+	case entity.RoleDoctor:
+		d, err := s.repo.DoctorByLogin(ctx, creds.Login)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return 0, errIncorrect
+			}
+
+			return 0, err
+		}
+
+		// Doctors linked to the identity provider sign in there only.
+		if d.OIDCSubject != nil || !d.ComparePassword(creds.Password) {
+			return 0, errIncorrect
+		}
+
+		return d.ID, nil
+	default:
+		return 0, fmt.Errorf("%w: unknown role %q", ErrUnauthorized, creds.Role)
+	}
+}
+
+// Password methods
+
+// ChangePassword replaces the caller's password after checking the old one.
+// Every session of the user is revoked and a fresh one is returned in place
+// of the current.
+func (s *PatientService) ChangePassword(ctx context.Context, sess entity.Session, ch entity.PasswordChange) (entity.Session, error) {
+	var v validator
+	v.check(ch.OldPassword != "", "old_password", "is required")
+	validatePassword(&v, "new_password", ch.NewPassword)
+
+	err := v.err()
+	if err != nil {
+		return entity.Session{}, err
+	}
+
+	var newSess entity.Session
+
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		login, err := tx.userLogin(ctx, sess.UserID, sess.Role)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.authenticate(ctx, entity.Credentials{Login: login, Password: ch.OldPassword, Role: sess.Role})
+		if err != nil {
+			if errors.Is(err, ErrUnauthorized) {
+				return &ValidationError{Fields: []FieldError{{Field: "old_password", Message: "is incorrect"}}}
+			}
+
+			return err
+		}
+
+		err = tx.setPassword(ctx, sess.UserID, sess.Role, ch.NewPassword)
+		if err != nil {
+			return err
+		}
+
+		newSess, err = tx.createSession(ctx, sess.UserID, sess.Role, sess.MFA)
+		if err != nil {
+			return fmt.Errorf("create session: %w", err)
+		}
+
+		return nil
+	})
+
+	return newSess, err
+}
+
+// RequestPasswordReset issues a single-use reset token and hands it to the
+// notifier. Unknown logins are ignored so that the endpoint cannot be used
+// to find out which accounts exist.
+func (s *PatientService) RequestPasswordReset(ctx context.Context, req entity.PasswordResetRequest) error {
+	if req.Role == "" {
+		req.Role = entity.RolePatient
+	}
+
+	userID, err := s.passwordUserID(ctx, req.Login, req.Role)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	pr := entity.PasswordReset{
+		TokenHash: hashToken(token),
+		UserID:    userID,
+		Role:      req.Role,
+		CreatedAt: now,
+		ExpiredAt: now.Add(s.passwordReset.TTL),
+	}
+
+	err = s.repo.CreatePasswordReset(ctx, pr)
+	if err != nil {
+		return fmt.Errorf("create password reset: %w", err)
+	}
+
+	return s.notifier.SendPasswordReset(ctx, req.Role, req.Login, token, pr.ExpiredAt)
+}
+
+// ResetPassword redeems a reset token and sets a new password, revoking
+// every session of the user.
+func (s *PatientService) ResetPassword(ctx context.Context, token, password string) error {
+	var v validator
+	validatePassword(&v, "password", password)
+
+	err := v.err()
+	if err != nil {
+		return err
+	}
+
+	return s.withTx(ctx, func(tx *PatientService) error {
+		pr, err := tx.repo.UsePasswordReset(ctx, hashToken(token), time.Now())
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("%w: reset token is invalid or expired", ErrNotFound)
+			}
+
+			return err
+		}
+
+		return tx.setPassword(ctx, pr.UserID, pr.Role, password)
+	})
+}
+
+func (s *PatientService) setPassword(ctx context.Context, userID int64, role entity.Role, password string) error {
+	hash, err := s.hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = s.repo.UpdatePassword(ctx, userID, role, hash)
+	if err != nil {
+		return fmt.Errorf("update password: %w", err)
+	}
+
+	err = s.repo.DeleteUserSessions(ctx, userID, role)
+	if err != nil {
+		return fmt.Errorf("delete sessions of %s %d: %w", role, userID, err)
+	}
+
+	return nil
+}
+
+func (s *PatientService) userLogin(ctx context.Context, userID int64, role entity.Role) (string, error) {
+	switch role {
+	case entity.RolePatient:
+		p, err := s.repo.PatientByID(ctx, userID)
+		return p.Login, err
+	case entity.RoleDoctor:
+		d, err := s.repo.DoctorByID(ctx, userID)
+		return d.Login, err
+	default:
+		return "", fmt.Errorf("%w: unknown role %q", ErrInvalid, role)
+	}
+}
+
+func (s *PatientService) userIDByLogin(ctx context.Context, login string, role entity.Role) (int64, error) {
+	switch role {
+	case entity.RolePatient:
+		p, err := s.repo.PatientByLogin(ctx, login)
+		return p.ID, err
+	case entity.RoleDoctor:
+		d, err := s.repo.DoctorByLogin(ctx, login)
+		return d.ID, err
+	default:
+		return 0, fmt.Errorf("%w: unknown role %q", ErrInvalid, role)
+	}
+}
+
+// passwordUserID is userIDByLogin limited to accounts that have a password.
+// Doctors linked to the identity provider are reported as not found.
+func (s *PatientService) passwordUserID(ctx context.Context, login string, role entity.Role) (int64, error) {
+	if role != entity.RoleDoctor {
+		return s.userIDByLogin(ctx, login, role)
+	}
+
+	d, err := s.repo.DoctorByLogin(ctx, login)
 	if err != nil {
-		return patient, err
+		return 0, err
 	}
 
-	return patient, nil
+	if d.OIDCSubject != nil {
+		return 0, fmt.Errorf("doctor %s signs in through single sign-on: %w", login, ErrNotFound)
+	}
+
+	return d.ID, nil
+}
+
+// newToken returns a random opaque token for links and refresh tokens.
+func newToken() (string, error) {
+	raw := make([]byte, tokenSize)
+
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", fmt.Errorf("generate token: %w", err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	purgedSessions     = expvar.NewInt("sessions_purged_total")
+	sessionPurgeRuns   = expvar.NewInt("session_purge_runs_total")
+	sessionPurgeErrors = expvar.NewInt("session_purge_errors_total")
+)
+
+// SessionJanitor periodically deletes sessions past their expiry.
+type SessionJanitor struct {
+	repo      PatientRepository
+	interval  time.Duration
+	batchSize int
+}
+
+func NewSessionJanitor(repo PatientRepository, interval time.Duration, batchSize int) (*SessionJanitor, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("session purge interval must be positive, got %s", interval)
+	}
+
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("session purge batch size must be positive, got %d", batchSize)
+	}
+
+	return &SessionJanitor{
+		repo:      repo,
+		interval:  interval,
+		batchSize: batchSize,
+	}, nil
+}
+
+// Run blocks until ctx is cancelled.
+func (j *SessionJanitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.purge(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (j *SessionJanitor) purge(ctx context.Context) {
+	sessionPurgeRuns.Add(1)
+
+	var total int64
+	now := time.Now()
+
+	for ctx.Err() == nil {
+		n, err := j.repo.DeleteExpiredSessions(ctx, now, j.batchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				sessionPurgeErrors.Add(1)
+				log.Println("purge expired sessions:", err)
+			}
+			break
+		}
+
+		total += n
+		purgedSessions.Add(n)
+
+		if n < int64(j.batchSize) {
+			break
+		}
+	}
+
+	if total > 0 {
+		log.Printf("purged %d expired sessions", total)
+	}
+}
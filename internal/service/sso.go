@@ -0,0 +1,209 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+// oidcSpecialization is stored for doctors created on their first single
+// sign-on, since providers have no claim for it.
+const oidcSpecialization = "Not specified"
+
+func newOIDCProvider(c OIDCOptions) *OIDCProvider {
+	if c.Issuer == "" {
+		return nil
+	}
+
+	return NewOIDCProvider(c, &http.Client{Timeout: c.HTTPTimeout})
+}
+
+// StartOIDCLogin begins a single sign-on login and returns the identity
+// provider URL to redirect to together with the state, which the caller must
+// bind to the browser. returnTo is a local path to go to afterwards.
+func (s *PatientService) StartOIDCLogin(ctx context.Context, returnTo string) (redirectURL, state string, err error) {
+	if s.oidc == nil {
+		return "", "", fmt.Errorf("%w: single sign-on is not configured", ErrNotFound)
+	}
+
+	if returnTo == "" {
+		returnTo = "/"
+	}
+
+	var v validator
+	v.check(isLocalPath(returnTo), "return_to", "must be a path on this server")
+
+	err = v.err()
+	if err != nil {
+		return "", "", err
+	}
+
+	var secrets [3]string
+	for i := range secrets {
+		secrets[i], err = newToken()
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+
+	redirectURL, err = s.oidc.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now()
+
+	err = s.repo.CreateOIDCLogin(ctx, entity.OIDCLogin{
+		StateHash:    hashToken(state),
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ReturnTo:     returnTo,
+		CreatedAt:    now,
+		ExpiredAt:    now.Add(s.oidcConfig.LoginTTL),
+	})
+	if err != nil {
+		return "", "", fmt.Errorf("store oidc login: %w", err)
+	}
+
+	return redirectURL, state, nil
+}
+
+// FinishOIDCLogin redeems the authorization code the identity provider sent
+// back with state and opens a doctor session. Staff without a local account
+// get one on their first login. It also returns the path the login was
+// started from.
+func (s *PatientService) FinishOIDCLogin(ctx context.Context, state, code string) (entity.Session, string, error) {
+	if s.oidc == nil {
+		return entity.Session{}, "", fmt.Errorf("%w: single sign-on is not configured", ErrNotFound)
+	}
+
+	login, err := s.repo.UseOIDCLogin(ctx, hashToken(state), time.Now())
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return entity.Session{}, "", fmt.Errorf("%w: unknown or expired login state", ErrUnauthorized)
+		}
+
+		return entity.Session{}, "", err
+	}
+
+	identity, err := s.oidc.Exchange(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		return entity.Session{}, "", err
+	}
+
+	mfa := entity.MFANone
+	if identity.MFA {
+		mfa = entity.MFAVerified
+	}
+
+	var sess entity.Session
+
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		d, err := tx.oidcDoctor(ctx, identity)
+		if err != nil {
+			return err
+		}
+
+		sess, err = tx.createSession(ctx, d.ID, entity.RoleDoctor, mfa)
+
+		return err
+	})
+
+	return sess, login.ReturnTo, err
+}
+
+// oidcDoctor finds the doctor linked to the identity, creating one if
+// needed, and brings their name and admin flag in line with the provider.
+// Accounts are linked by subject only, never by login, so that a provider
+// account cannot take over an existing local one.
+func (s *PatientService) oidcDoctor(ctx context.Context, id entity.OIDCIdentity) (entity.Doctor, error) {
+	if !containsString(id.Roles, s.oidcConfig.DoctorRole) {
+		return entity.Doctor{}, fmt.Errorf("%w: the identity provider grants no doctor role", ErrForbidden)
+	}
+
+	isAdmin := containsString(id.Roles, s.oidcConfig.AdminRole)
+	now := time.Now()
+
+	d, err := s.repo.DoctorByOIDCSubject(ctx, id.Subject)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		login, err := s.oidcLogin(ctx, id)
+		if err != nil {
+			return d, err
+		}
+
+		d = entity.Doctor{
+			FullName:       strings.TrimSpace(id.FullName),
+			Specialization: oidcSpecialization,
+			Login:          login,
+			IsAdmin:        isAdmin,
+			OIDCSubject:    &id.Subject,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if d.FullName == "" {
+			d.FullName = d.Login
+		}
+
+		d, err = s.repo.CreateDoctor(ctx, d)
+		if err != nil {
+			return d, fmt.Errorf("create doctor: %w", err)
+		}
+
+		return d, nil
+	case err != nil:
+		return d, err
+	}
+
+	name := strings.TrimSpace(id.FullName)
+	if (name == "" || name == d.FullName) && isAdmin == d.IsAdmin {
+		return d, nil
+	}
+
+	if name != "" {
+		d.FullName = name
+	}
+	d.IsAdmin = isAdmin
+	d.UpdatedAt = now
+
+	return d, s.repo.UpdateDoctorIdentity(ctx, d)
+}
+
+// oidcLogin picks the login of a doctor created from an identity: the one
+// the provider suggests, or one derived from the subject if that is not a
+// valid login or is taken, since a clash would otherwise block the doctor
+// from signing in. Subjects are opaque, so the last resort is their hash.
+func (s *PatientService) oidcLogin(ctx context.Context, id entity.OIDCIdentity) (string, error) {
+	candidates := []string{id.Login, "oidc-" + id.Subject, "oidc-" + hashToken(id.Subject)[:32]}
+
+	for _, login := range candidates {
+		var v validator
+		validateLogin(&v, login)
+		if v.err() != nil {
+			continue
+		}
+
+		_, err := s.repo.DoctorByLogin(ctx, login)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			return login, nil
+		case err != nil:
+			return "", err
+		}
+	}
+
+	return "", fmt.Errorf("%w: no free login for subject %q", ErrConflict, id.Subject)
+}
+
+// isLocalPath rejects absolute and scheme-relative URLs so that a login
+// cannot end on another site.
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.ContainsAny(p, "\\\r\n")
+}
@@ -0,0 +1,189 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+// IssueTokens logs in like Login but hands out a bearer access token and a
+// refresh token instead of a cookie. Both are backed by the same sessions
+// row, so logging out revokes them as well. Users with 2FA have to send the
+// one-time code along with the password since there is no cookie to carry a
+// pending session.
+func (s *PatientService) IssueTokens(ctx context.Context, creds entity.Credentials, ip string) (entity.TokenPair, error) {
+	err := s.checkTokensEnabled()
+	if err != nil {
+		return entity.TokenPair{}, err
+	}
+
+	sess, err := s.Login(ctx, creds, ip)
+	if err != nil {
+		return entity.TokenPair{}, err
+	}
+
+	if sess.MFA == entity.MFAPending {
+		err = s.repo.DeleteSession(ctx, sess.ID.String())
+		if err != nil {
+			return entity.TokenPair{}, fmt.Errorf("delete pending session: %w", err)
+		}
+
+		return entity.TokenPair{}, fmt.Errorf("%w: two-factor code required", ErrUnauthorized)
+	}
+
+	return s.issueTokens(ctx, sess)
+}
+
+// RefreshTokens trades a refresh token for a new pair. The old refresh token
+// stops working, so a stolen one is only good until its owner refreshes.
+func (s *PatientService) RefreshTokens(ctx context.Context, refreshToken string) (entity.TokenPair, error) {
+	err := s.checkTokensEnabled()
+	if err != nil {
+		return entity.TokenPair{}, err
+	}
+
+	errInvalid := fmt.Errorf("%w: invalid refresh token", ErrUnauthorized)
+
+	sess, err := s.repo.SessionByRefreshToken(ctx, hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return entity.TokenPair{}, errInvalid
+		}
+
+		return entity.TokenPair{}, err
+	}
+
+	if time.Now().After(sess.ExpiredAt) {
+		return entity.TokenPair{}, errInvalid
+	}
+
+	sess, _, err = s.extendSession(ctx, sess)
+	if err != nil {
+		return entity.TokenPair{}, err
+	}
+
+	return s.issueTokens(ctx, sess)
+}
+
+// ChangePasswordTokens changes the password like ChangePassword for a bearer
+// client. Changing the password ends every session, the caller's included,
+// so the caller gets a new token pair in place of a cookie.
+func (s *PatientService) ChangePasswordTokens(ctx context.Context, sess entity.Session, ch entity.PasswordChange) (entity.TokenPair, error) {
+	sess, err := s.ChangePassword(ctx, sess, ch)
+	if err != nil {
+		return entity.TokenPair{}, err
+	}
+
+	return s.issueTokens(ctx, sess)
+}
+
+// SessionByAccessToken verifies an access token and returns the session it
+// was issued for.
+func (s *PatientService) SessionByAccessToken(ctx context.Context, token string) (entity.Session, error) {
+	claims, err := parseJWT(token, s.jwt.Keys)
+	if err != nil {
+		return entity.Session{}, fmt.Errorf("%w: %v", ErrUnauthorized, err)
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != s.jwt.Issuer:
+		return entity.Session{}, fmt.Errorf("%w: unexpected issuer %q", ErrUnauthorized, claims.Issuer)
+	case claims.Audience != s.jwt.Audience:
+		return entity.Session{}, fmt.Errorf("%w: unexpected audience %q", ErrUnauthorized, claims.Audience)
+	case now.Add(-jwtClockLeeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return entity.Session{}, fmt.Errorf("%w: token expired", ErrUnauthorized)
+	case now.Add(jwtClockLeeway).Before(time.Unix(claims.IssuedAt, 0)):
+		return entity.Session{}, fmt.Errorf("%w: token issued in the future", ErrUnauthorized)
+	}
+
+	if claims.TokenID == "" {
+		return entity.Session{}, fmt.Errorf("%w: token has no token id", ErrUnauthorized)
+	}
+
+	sess, err := s.repo.SessionByTokenID(ctx, claims.TokenID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return entity.Session{}, fmt.Errorf("%w: session revoked", ErrUnauthorized)
+		}
+
+		return entity.Session{}, err
+	}
+
+	if now.After(sess.ExpiredAt) {
+		return entity.Session{}, fmt.Errorf("%w: session expired", ErrUnauthorized)
+	}
+
+	if strconv.FormatInt(sess.UserID, 10) != claims.Subject || sess.Role != claims.Role {
+		return entity.Session{}, fmt.Errorf("%w: token does not match its session", ErrUnauthorized)
+	}
+
+	return sess, nil
+}
+
+func (s *PatientService) checkTokensEnabled() error {
+	if len(s.jwt.Keys) == 0 {
+		return fmt.Errorf("%w: bearer tokens are not configured", ErrNotFound)
+	}
+
+	return nil
+}
+
+// issueTokens signs a new access token and only then swaps the refresh
+// token, so a signing failure leaves the old refresh token usable.
+func (s *PatientService) issueTokens(ctx context.Context, sess entity.Session) (entity.TokenPair, error) {
+	tokenID := sess.TokenID
+	if tokenID == "" {
+		var err error
+		tokenID, err = newToken()
+		if err != nil {
+			return entity.TokenPair{}, err
+		}
+	}
+
+	now := time.Now()
+
+	expiresAt := now.Add(s.jwt.AccessTTL)
+	if expiresAt.After(sess.ExpiredAt) {
+		expiresAt = sess.ExpiredAt
+	}
+
+	accessToken, err := signJWT(accessClaims{
+		Issuer:    s.jwt.Issuer,
+		Subject:   strconv.FormatInt(sess.UserID, 10),
+		Audience:  s.jwt.Audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+		TokenID:   tokenID,
+		Role:      sess.Role,
+	}, s.jwt.SigningKeyID, []byte(s.jwt.Keys[s.jwt.SigningKeyID]))
+	if err != nil {
+		return entity.TokenPair{}, fmt.Errorf("sign access token: %w", err)
+	}
+
+	refreshToken, err := newToken()
+	if err != nil {
+		return entity.TokenPair{}, err
+	}
+
+	err = s.repo.UpdateSessionRefreshToken(ctx, sess.ID, tokenID, sess.RefreshTokenHash, hashToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return entity.TokenPair{}, fmt.Errorf("%w: refresh token already used", ErrUnauthorized)
+		}
+
+		return entity.TokenPair{}, fmt.Errorf("store refresh token: %w", err)
+	}
+
+	return entity.TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(expiresAt.Sub(now).Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
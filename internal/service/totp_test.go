@@ -0,0 +1,45 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestTOTP checks the SHA1 test vectors of RFC 6238, appendix B.
+func TestTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, v := range vectors {
+		assert.Equal(t, v.code, hotp(secret, uint64(totpStep(time.Unix(v.unix, 0))), 8), "time %d", v.unix)
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111111, 0)
+	code := hotp(secret, uint64(totpStep(now)), totpDigits)
+
+	step, ok := matchTOTP(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, totpStep(now), step)
+
+	_, ok = matchTOTP(secret, code, now.Add(totpPeriod))
+	assert.True(t, ok, "a code one step old is still accepted")
+
+	_, ok = matchTOTP(secret, code, now.Add(2*totpPeriod))
+	assert.False(t, ok, "a code two steps old is rejected")
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"medical-card/internal/entity"
+)
+
+const (
+	totpSecretSize     = 20
+	recoveryCodeCount  = 10
+	recoveryCodeSize   = 5
+	errCodeInvalidText = "invalid two-factor code"
+)
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// EnrollTOTP creates an authenticator secret and recovery codes for the
+// caller. 2FA is not enforced until the enrollment is confirmed with a code.
+func (s *PatientService) EnrollTOTP(ctx context.Context, sess entity.Session) (entity.TOTPEnrollment, error) {
+	var enrollment entity.TOTPEnrollment
+
+	login, err := s.userLogin(ctx, sess.UserID, sess.Role)
+	if err != nil {
+		return enrollment, err
+	}
+
+	raw := make([]byte, totpSecretSize)
+
+	_, err = rand.Read(raw)
+	if err != nil {
+		return enrollment, fmt.Errorf("generate totp secret: %w", err)
+	}
+
+	enrollment.Secret = base32NoPadding.EncodeToString(raw)
+	enrollment.URI = s.otpauthURI(login, enrollment.Secret)
+
+	err = s.withTx(ctx, func(tx *PatientService) error {
+		err := tx.repo.SaveTOTP(ctx, entity.TOTP{
+			UserID:    sess.UserID,
+			Role:      sess.Role,
+			Secret:    enrollment.Secret,
+			CreatedAt: time.Now(),
+		})
+		if err != nil {
+			if errors.Is(err, ErrAlreadyExists) {
+				return fmt.Errorf("%w: two-factor authentication is already enabled", ErrConflict)
+			}
+
+			return err
+		}
+
+		enrollment.RecoveryCodes, err = tx.replaceRecoveryCodes(ctx, sess.UserID, sess.Role)
+
+		return err
+	})
+
+	return enrollment, err
+}
+
+// ConfirmTOTP enables 2FA once the user shows a code from the enrolled
+// authenticator.
+func (s *PatientService) ConfirmTOTP(ctx context.Context, sess entity.Session, code string) error {
+	err := s.withThrottledCode(ctx, sess, "", func(tx *PatientService) error {
+		t, err := tx.repo.TOTPByUser(ctx, sess.UserID, sess.Role)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return fmt.Errorf("%w: two-factor authentication is not enrolled", ErrConflict)
+			}
+
+			return err
+		}
+
+		if t.EnabledAt != nil {
+			return fmt.Errorf("%w: two-factor authentication is already enabled", ErrConflict)
+		}
+
+		err = tx.useTOTPCode(ctx, t, strings.TrimSpace(code))
+		if err != nil {
+			return err
+		}
+
+		return tx.repo.EnableTOTP(ctx, sess.UserID, sess.Role, time.Now())
+	})
+
+	return codeFieldError(err)
+}
+
+// DisableTOTP turns 2FA off after checking a current or recovery code.
+func (s *PatientService) DisableTOTP(ctx context.Context, sess entity.Session, code string) error {
+	err := s.withThrottledCode(ctx, sess, "", func(tx *PatientService) error {
+		err := tx.checkSecondFactor(ctx, sess.UserID, sess.Role, code)
+		if err != nil {
+			return err
+		}
+
+		return tx.repo.DeleteTOTP(ctx, sess.UserID, sess.Role)
+	})
+
+	return codeFieldError(err)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the caller.
+func (s *PatientService) RegenerateRecoveryCodes(ctx context.Context, sess entity.Session, code string) ([]string, error) {
+	var codes []string
+
+	err := s.withThrottledCode(ctx, sess, "", func(tx *PatientService) error {
+		err := tx.checkSecondFactor(ctx, sess.UserID, sess.Role, code)
+		if err != nil {
+			return err
+		}
+
+		codes, err = tx.replaceRecoveryCodes(ctx, sess.UserID, sess.Role)
+
+		return err
+	})
+
+	return codes, codeFieldError(err)
+}
+
+// ResetTOTP removes 2FA from an account whose owner lost the authenticator
+// and their recovery codes, and logs the account out everywhere.
+func (s *PatientService) ResetTOTP(ctx context.Context, req entity.UnlockRequest) error {
+	if req.Role == "" {
+		req.Role = entity.RolePatient
+	}
+
+	return s.withTx(ctx, func(tx *PatientService) error {
+		userID, err := tx.userIDByLogin(ctx, req.Login, req.Role)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", req.Role, req.Login, err)
+		}
+
+		err = tx.repo.DeleteTOTP(ctx, userID, req.Role)
+		if err != nil {
+			return err
+		}
+
+		return tx.repo.DeleteUserSessions(ctx, userID, req.Role)
+	})
+}
+
+// VerifySecondFactor upgrades a session waiting for its second factor. The
+// pending session is replaced by a new one so that its id, which was handed
+// out before the second factor, does not grant full access.
+func (s *PatientService) VerifySecondFactor(ctx context.Context, sess entity.Session, code, ip string) (entity.Session, error) {
+	if sess.MFA != entity.MFAPending {
+		return entity.Session{}, fmt.Errorf("%w: session is not waiting for a second factor", ErrConflict)
+	}
+
+	var newSess entity.Session
+
+	err := s.withThrottledCode(ctx, sess, ip, func(tx *PatientService) error {
+		err := tx.checkSecondFactor(ctx, sess.UserID, sess.Role, code)
+		if err != nil {
+			return err
+		}
+
+		err = tx.repo.DeleteSession(ctx, sess.ID.String())
+		if err != nil {
+			return fmt.Errorf("delete pending session: %w", err)
+		}
+
+		newSess, err = tx.createSession(ctx, sess.UserID, sess.Role, entity.MFAVerified)
+
+		return err
+	})
+
+	return newSess, err
+}
+
+// withThrottledCode runs fn, which checks a one-time code, in a transaction.
+// Wrong codes count as failed logins so that the code space cannot be
+// searched, not even by someone holding a stolen session.
+func (s *PatientService) withThrottledCode(ctx context.Context, sess entity.Session, ip string, fn func(tx *PatientService) error) error {
+	login, err := s.userLogin(ctx, sess.UserID, sess.Role)
+	if err != nil {
+		return err
+	}
+
+	keys := newLoginKeys(login, sess.Role, ip)
+
+	err = s.checkLoginAllowed(ctx, keys)
+	if err != nil {
+		return err
+	}
+
+	err = s.withTx(ctx, fn)
+	if err != nil {
+		if errors.Is(err, ErrUnauthorized) {
+			ferr := s.recordLoginFailure(ctx, keys)
+			if ferr != nil {
+				return ferr
+			}
+		}
+
+		return err
+	}
+
+	return s.repo.DeleteLoginAttempts(ctx, keys.account)
+}
+
+// codeFieldError reports a wrong code to a signed in user as a validation
+// error, since a 401 would suggest that their session is gone.
+func codeFieldError(err error) error {
+	if errors.Is(err, ErrUnauthorized) {
+		return &ValidationError{Fields: []FieldError{{Field: "code", Message: "is incorrect"}}}
+	}
+
+	return err
+}
+
+// CheckMFAPolicy enforces the rule that doctors may only reach patient
+// records and medical cards from sessions that passed 2FA, unless that rule
+// is turned off.
+func (s *PatientService) CheckMFAPolicy(sess entity.Session) error {
+	if s.totp.RequiredForDoctors && sess.Role == entity.RoleDoctor && sess.MFA != entity.MFAVerified {
+		return fmt.Errorf("%w: doctors need two-factor authentication to access patient records", ErrForbidden)
+	}
+
+	return nil
+}
+
+// loginMFA decides the 2FA state of a session opened with valid credentials:
+// none for users without 2FA, verified if otp checks out and pending
+// otherwise.
+func (s *PatientService) loginMFA(ctx context.Context, userID int64, role entity.Role, otp string) (entity.MFAState, error) {
+	t, err := s.repo.TOTPByUser(ctx, userID, role)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return entity.MFANone, nil
+	case err != nil:
+		return "", err
+	case t.EnabledAt == nil:
+		return entity.MFANone, nil
+	case otp == "":
+		return entity.MFAPending, nil
+	}
+
+	err = s.checkSecondFactor(ctx, userID, role, otp)
+	if err != nil {
+		return "", err
+	}
+
+	return entity.MFAVerified, nil
+}
+
+// checkSecondFactor accepts either a code from the authenticator or one of
+// the recovery codes, each of them only once.
+func (s *PatientService) checkSecondFactor(ctx context.Context, userID int64, role entity.Role, code string) error {
+	t, err := s.repo.TOTPByUser(ctx, userID, role)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w: two-factor authentication is not enabled", ErrConflict)
+		}
+
+		return err
+	}
+
+	if t.EnabledAt == nil {
+		return fmt.Errorf("%w: two-factor authentication is not enabled", ErrConflict)
+	}
+
+	code = strings.TrimSpace(code)
+	if len(code) == totpDigits {
+		return s.useTOTPCode(ctx, t, code)
+	}
+
+	err = s.repo.UseRecoveryCode(ctx, userID, role, hashToken(normalizeRecoveryCode(code)), time.Now())
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w: %s", ErrUnauthorized, errCodeInvalidText)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *PatientService) useTOTPCode(ctx context.Context, t entity.TOTP, code string) error {
+	secret, err := base32NoPadding.DecodeString(t.Secret)
+	if err != nil {
+		return fmt.Errorf("decode totp secret: %w", err)
+	}
+
+	step, ok := matchTOTP(secret, code, time.Now())
+	if !ok || step <= t.LastUsedStep {
+		return fmt.Errorf("%w: %s", ErrUnauthorized, errCodeInvalidText)
+	}
+
+	err = s.repo.UseTOTPStep(ctx, t.UserID, t.Role, step)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return fmt.Errorf("%w: %s", ErrUnauthorized, errCodeInvalidText)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (s *PatientService) replaceRecoveryCodes(ctx context.Context, userID int64, role entity.Role) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		raw := make([]byte, recoveryCodeSize)
+
+		_, err := rand.Read(raw)
+		if err != nil {
+			return nil, fmt.Errorf("generate recovery code: %w", err)
+		}
+
+		codes[i] = strings.ToLower(base32NoPadding.EncodeToString(raw))
+		hashes[i] = hashToken(codes[i])
+	}
+
+	err := s.repo.ReplaceRecoveryCodes(ctx, userID, role, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("store recovery codes: %w", err)
+	}
+
+	return codes, nil
+}
+
+func (s *PatientService) otpauthURI(login, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", s.totp.Issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(int(totpPeriod/time.Second)))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + s.totp.Issuer + ":" + login,
+		RawQuery: q.Encode(),
+	}
+
+	return u.String()
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(code, "-", ""))
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"medical-card/internal/entity"
+)
+
+const (
+	minLoginLength    = 3
+	maxLoginLength    = 64
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores everything past 72 bytes
+	maxNameLength     = 200
+	maxTextLength     = 10000
+)
+
+var (
+	loginRe    = regexp.MustCompile(`^[a-zA-Z0-9@._-]+$`)
+	phoneRe    = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+	passportRe = regexp.MustCompile(`^[A-Z0-9]{5,20}$`)
+
+	minDateOfBorn = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// validator collects field errors so that a client sees every problem with
+// its payload at once instead of fixing them one by one.
+type validator struct {
+	fields []FieldError
+}
+
+func (v *validator) check(ok bool, field, message string) {
+	if !ok {
+		v.fields = append(v.fields, FieldError{Field: field, Message: message})
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Fields: v.fields}
+}
+
+func validatePatient(p entity.Patient, withPassword bool) error {
+	var v validator
+
+	name := strings.TrimSpace(p.FullName)
+	v.check(name != "", "full_name", "is required")
+	v.check(len(name) <= maxNameLength, "full_name", fmt.Sprintf("must be at most %d characters", maxNameLength))
+
+	v.check(!p.DateOfBorn.IsZero(), "date_of_born", "is required")
+	v.check(p.DateOfBorn.IsZero() || !p.DateOfBorn.After(time.Now()), "date_of_born", "must not be in the future")
+	v.check(p.DateOfBorn.IsZero() || !p.DateOfBorn.Before(minDateOfBorn), "date_of_born", "must not be before 1900")
+
+	v.check(phoneRe.MatchString(normalizePhone(p.PhoneNumber)), "phone_number", "must contain 7 to 15 digits")
+	v.check(passportRe.MatchString(p.PassportNumber), "passport_number", "must be 5 to 20 uppercase letters or digits")
+
+	validateLogin(&v, p.Login)
+	if withPassword {
+		validatePassword(&v, "password", p.Password)
+	}
+
+	return v.err()
+}
+
+func validateDoctor(d entity.Doctor) error {
+	var v validator
+
+	name := strings.TrimSpace(d.FullName)
+	v.check(name != "", "full_name", "is required")
+	v.check(len(name) <= maxNameLength, "full_name", fmt.Sprintf("must be at most %d characters", maxNameLength))
+	v.check(strings.TrimSpace(d.Specialization) != "", "specialization", "is required")
+
+	validateLogin(&v, d.Login)
+	validatePassword(&v, "password", d.Password)
+
+	return v.err()
+}
+
+func validateCard(c entity.Card) error {
+	var v validator
+
+	v.check(c.PatientID > 0, "patient_id", "is required")
+	v.check(c.BloodType >= 1 && c.BloodType <= 4, "blood_type", "must be between 1 and 4")
+	v.check(c.DisabilityGroup == nil || (*c.DisabilityGroup >= 1 && *c.DisabilityGroup <= 3), "disability_group", "must be between 1 and 3")
+
+	for i, disease := range c.ChronicDiseases {
+		v.check(strings.TrimSpace(disease) != "", fmt.Sprintf("chronic_diseases[%d]", i), "must not be empty")
+	}
+
+	return v.err()
+}
+
+func validateConsultation(c entity.Consultation) error {
+	var v validator
+
+	v.check(strings.TrimSpace(c.Complaints) != "", "complaints", "is required")
+	v.check(len(c.Complaints) <= maxTextLength, "complaints", fmt.Sprintf("must be at most %d characters", maxTextLength))
+	v.check(len(c.Descriptions) <= maxTextLength, "descriptions", fmt.Sprintf("must be at most %d characters", maxTextLength))
+	v.check(len(c.Recommendations) <= maxTextLength, "recommendations", fmt.Sprintf("must be at most %d characters", maxTextLength))
+
+	return v.err()
+}
+
+func validateAPIKey(k entity.APIKey) error {
+	var v validator
+
+	name := strings.TrimSpace(k.Name)
+	v.check(name != "", "name", "is required")
+	v.check(len(name) <= maxNameLength, "name", fmt.Sprintf("must be at most %d characters", maxNameLength))
+	v.check(len(k.Scopes) > 0, "scopes", "must not be empty")
+
+	for i, scope := range k.Scopes {
+		known := false
+		for _, s := range entity.Scopes {
+			known = known || s == scope
+		}
+
+		v.check(known, fmt.Sprintf("scopes[%d]", i), "must be one of "+strings.Join(entity.Scopes, ", "))
+	}
+
+	return v.err()
+}
+
+func validateLogin(v *validator, login string) {
+	v.check(len(login) >= minLoginLength && len(login) <= maxLoginLength, "login",
+		fmt.Sprintf("must be between %d and %d characters", minLoginLength, maxLoginLength))
+	v.check(loginRe.MatchString(login), "login", "may only contain letters, digits and @._-")
+}
+
+func validatePassword(v *validator, field, password string) {
+	v.check(len(password) >= minPasswordLength && len(password) <= maxPasswordLength, field,
+		fmt.Sprintf("must be between %d and %d characters", minPasswordLength, maxPasswordLength))
+	v.check(strings.IndexFunc(password, unicode.IsLetter) >= 0 && strings.IndexFunc(password, unicode.IsDigit) >= 0, field,
+		"must contain at least one letter and one digit")
+}
+
+func normalizePhone(phone string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')':
+			return -1
+		}
+		return r
+	}, phone)
+}
@@ -1,35 +1,113 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"medical-card/internal/api"
 	"medical-card/internal/app"
 	"medical-card/internal/dal"
+	"medical-card/internal/entity"
 	"medical-card/internal/service"
 )
 
 func main() {
-	c, err := app.NewConfig()
+	err := run()
 	if err != nil {
 		log.Fatal(err)
 	}
+}
+
+func run() error {
+	c, err := app.NewConfig()
+	if err != nil {
+		return err
+	}
 
 	db, err := app.NewPostgresClient(c.Database)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer db.Close()
 
 	patientRepository := dal.NewPatientRepository(db)
-	patientService := service.NewPatientService(patientRepository)
-	patientHandler := api.NewPatientHandler(patientService)
-	authMw := api.NewAuthMiddleware(patientService)
-	server := api.NewServer(c.Port, patientHandler, authMw)
+	patientService, err := service.NewPatientService(patientRepository, serviceOptions(c), service.LogNotifier{})
+	if err != nil {
+		return err
+	}
+
+	if c.Admin.Login != "" {
+		created, err := patientService.BootstrapAdmin(context.Background(), entity.Doctor{
+			FullName:       c.Admin.FullName,
+			Specialization: c.Admin.Specialization,
+			Login:          c.Admin.Login,
+			Password:       c.Admin.Password,
+		})
+		if err != nil {
+			return fmt.Errorf("bootstrap admin: %w", err)
+		}
+
+		if created {
+			log.Println("created admin doctor:", c.Admin.Login)
+		}
+	}
+
+	sessionJanitor, err := service.NewSessionJanitor(patientRepository, c.Session.PurgeInterval, c.Session.PurgeBatchSize)
+	if err != nil {
+		return err
+	}
+
+	cookies, err := api.NewCookies(c.Cookie)
+	if err != nil {
+		return err
+	}
+
+	patientHandler := api.NewPatientHandler(patientService, cookies)
+	authMw := api.NewAuthMiddleware(patientService, cookies)
+	server := api.NewServer(c.Port, c.ShutdownTimeout, patientHandler, authMw)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		sessionJanitor.Run(ctx)
+	}()
 
 	log.Println("server started at:", c.Port)
-	err = server.Start()
+	err = server.Start(ctx)
+	stop()
+	wg.Wait()
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	log.Println("server stopped")
+
+	return nil
+}
+
+// serviceOptions hands the service its settings. The conversions rely on the
+// config structs having the same fields as the option structs, so the build
+// breaks if they drift apart.
+func serviceOptions(c app.Config) service.Options {
+	return service.Options{
+		Session: service.SessionOptions{
+			TTL:         c.Session.TTL,
+			MaxLifetime: c.Session.MaxLifetime,
+			Sliding:     c.Session.Sliding,
+		},
+		PasswordReset: service.PasswordResetOptions(c.PasswordReset),
+		LoginThrottle: service.LoginThrottleOptions(c.LoginThrottle),
+		JWT:           service.JWTOptions(c.JWT),
+		TOTP:          service.TOTPOptions(c.TOTP),
+		OIDC:          service.OIDCOptions(c.OIDC),
 	}
 }
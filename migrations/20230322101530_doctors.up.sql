@@ -0,0 +1,9 @@
+CREATE TABLE doctors (
+    id BIGSERIAL PRIMARY KEY,
+    full_name TEXT NOT NULL,
+    specialization TEXT NOT NULL,
+    login TEXT UNIQUE NOT NULL,
+    password TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
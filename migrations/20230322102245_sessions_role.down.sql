@@ -0,0 +1,4 @@
+DELETE FROM sessions WHERE role <> 'patient';
+ALTER TABLE sessions DROP COLUMN role;
+ALTER TABLE sessions RENAME COLUMN user_id TO patient_id;
+ALTER TABLE sessions ADD CONSTRAINT sessions_patient_id_fkey FOREIGN KEY (patient_id) REFERENCES patients(id);
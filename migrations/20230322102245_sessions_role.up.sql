@@ -0,0 +1,3 @@
+ALTER TABLE sessions DROP CONSTRAINT sessions_patient_id_fkey;
+ALTER TABLE sessions RENAME COLUMN patient_id TO user_id;
+ALTER TABLE sessions ADD COLUMN role TEXT NOT NULL DEFAULT 'patient';
@@ -0,0 +1,22 @@
+ALTER TABLE cards ADD COLUMN consultations JSONB NOT NULL DEFAULT '[]';
+
+UPDATE cards c
+SET consultations = (
+    SELECT COALESCE(jsonb_agg(jsonb_build_object(
+        'id', cs.id,
+        'card_id', cs.card_id,
+        'doctor_id', cs.doctor_id::TEXT,
+        'full_name', cs.full_name,
+        'complaints', cs.complaints,
+        'descriptions', cs.descriptions,
+        'recommendations', cs.recommendations,
+        'created_at', cs.created_at,
+        'updated_at', cs.updated_at
+    ) ORDER BY cs.id), '[]')
+    FROM consultations cs
+    WHERE cs.card_id = c.id
+);
+
+ALTER TABLE cards ALTER COLUMN consultations DROP DEFAULT;
+
+DROP TABLE consultations;
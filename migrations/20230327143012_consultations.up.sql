@@ -0,0 +1,30 @@
+CREATE TABLE consultations (
+    id BIGSERIAL PRIMARY KEY,
+    card_id BIGINT NOT NULL REFERENCES cards(id),
+    doctor_id BIGINT REFERENCES doctors(id),
+    full_name TEXT NOT NULL,
+    complaints TEXT NOT NULL,
+    descriptions TEXT NOT NULL,
+    recommendations TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX consultations_card_id_idx ON consultations (card_id, id);
+
+INSERT INTO consultations (card_id, doctor_id, full_name, complaints, descriptions, recommendations, created_at, updated_at)
+SELECT c.id,
+       d.id,
+       COALESCE(e->>'full_name', ''),
+       COALESCE(e->>'complaints', ''),
+       COALESCE(e->>'descriptions', ''),
+       COALESCE(e->>'recommendations', ''),
+       COALESCE((e->>'created_at')::TIMESTAMPTZ, c.created_at),
+       COALESCE((e->>'updated_at')::TIMESTAMPTZ, c.updated_at)
+FROM cards c
+CROSS JOIN LATERAL jsonb_array_elements(c.consultations) AS e
+LEFT JOIN doctors d ON d.id::TEXT = e->>'doctor_id'
+WHERE jsonb_typeof(c.consultations) = 'array'
+ORDER BY c.id, COALESCE((e->>'created_at')::TIMESTAMPTZ, c.created_at);
+
+ALTER TABLE cards DROP COLUMN consultations;
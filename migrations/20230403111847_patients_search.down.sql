@@ -0,0 +1,6 @@
+DROP INDEX patients_search_document_idx;
+DROP INDEX patients_address_text_trgm_idx;
+DROP INDEX patients_phone_number_trgm_idx;
+DROP INDEX patients_full_name_trgm_idx;
+
+ALTER TABLE patients DROP COLUMN search_document, DROP COLUMN address_text;
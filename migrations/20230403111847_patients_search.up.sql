@@ -0,0 +1,23 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE patients
+    ADD COLUMN address_text TEXT GENERATED ALWAYS AS (
+        coalesce(address->>'country', '') || ' ' ||
+        coalesce(address->>'city', '') || ' ' ||
+        coalesce(address->>'street', '') || ' ' ||
+        coalesce(address->>'building', '')
+    ) STORED,
+    ADD COLUMN search_document TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('simple', full_name), 'A') ||
+        setweight(to_tsvector('simple', phone_number), 'B') ||
+        setweight(to_tsvector('simple',
+            coalesce(address->>'country', '') || ' ' ||
+            coalesce(address->>'city', '') || ' ' ||
+            coalesce(address->>'street', '')
+        ), 'C')
+    ) STORED;
+
+CREATE INDEX patients_full_name_trgm_idx ON patients USING GIN (full_name gin_trgm_ops);
+CREATE INDEX patients_phone_number_trgm_idx ON patients USING GIN (phone_number gin_trgm_ops);
+CREATE INDEX patients_address_text_trgm_idx ON patients USING GIN (address_text gin_trgm_ops);
+CREATE INDEX patients_search_document_idx ON patients USING GIN (search_document);
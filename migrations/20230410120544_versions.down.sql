@@ -0,0 +1,2 @@
+ALTER TABLE cards DROP COLUMN version;
+ALTER TABLE patients DROP COLUMN version;
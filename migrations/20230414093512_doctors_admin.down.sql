@@ -0,0 +1 @@
+ALTER TABLE doctors DROP COLUMN is_admin;
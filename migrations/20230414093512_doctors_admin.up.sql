@@ -0,0 +1 @@
+ALTER TABLE doctors ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT false;
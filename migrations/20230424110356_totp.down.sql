@@ -0,0 +1,3 @@
+ALTER TABLE sessions DROP COLUMN mfa;
+DROP TABLE totp_recovery_codes;
+DROP TABLE user_totp;
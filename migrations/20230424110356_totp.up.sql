@@ -0,0 +1,19 @@
+CREATE TABLE user_totp (
+    user_id BIGINT NOT NULL,
+    role TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    enabled_at TIMESTAMPTZ,
+    last_used_step BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (user_id, role)
+);
+
+CREATE TABLE totp_recovery_codes (
+    user_id BIGINT NOT NULL,
+    role TEXT NOT NULL,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMPTZ,
+    PRIMARY KEY (user_id, role, code_hash)
+);
+
+ALTER TABLE sessions ADD COLUMN mfa TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP TABLE oidc_logins;
+ALTER TABLE doctors DROP COLUMN oidc_subject;
@@ -0,0 +1,12 @@
+ALTER TABLE doctors ADD COLUMN oidc_subject TEXT UNIQUE;
+
+CREATE TABLE oidc_logins (
+    state_hash TEXT PRIMARY KEY,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    return_to TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL,
+    expired_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX oidc_logins_expired_at_idx ON oidc_logins (expired_at);
@@ -0,0 +1 @@
+ALTER TABLE sessions ADD COLUMN token_id TEXT UNIQUE;
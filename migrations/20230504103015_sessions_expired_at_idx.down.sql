@@ -0,0 +1 @@
+DROP INDEX sessions_expired_at_idx;
@@ -0,0 +1 @@
+CREATE INDEX sessions_expired_at_idx ON sessions (expired_at);
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createAPIKey(t *testing.T, admin *testClient, scopes ...string) entity.APIKey {
+	resp := admin.do(http.MethodPost, "/admin/api-keys", entity.APIKey{Name: "lab", Scopes: scopes})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var k entity.APIKey
+	decode(t, resp, &k)
+	require.NotEmpty(t, k.Key)
+
+	return k
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("cuddy", "dean2023", true)
+	p := a.addPatient("nasta", "nasta2023")
+	card := a.addCard(p.ID)
+
+	admin := a.client()
+	require.Equal(t, http.StatusOK, admin.login("cuddy", "dean2023", entity.RoleDoctor).StatusCode)
+	k := createAPIKey(t, admin, entity.ScopeCardsRead)
+
+	svc := a.client()
+	withKey := func(method, path string, body any, header ...string) int {
+		return svc.do(method, path, body, append([]string{"X-API-Key", k.Key}, header...)...).StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, withKey(http.MethodGet, "/cards/"+itoa(card.ID), nil))
+	assert.Equal(t, http.StatusOK, withKey(http.MethodGet, "/patients/"+itoa(p.ID)+"/card", nil))
+
+	assert.Equal(t, http.StatusForbidden, withKey(http.MethodGet, "/patients/"+p.PassportNumber, nil))
+	assert.Equal(t, http.StatusForbidden, withKey(http.MethodPatch, "/cards/"+itoa(card.ID), `{"blood_type": 1}`,
+		"Content-Type", "application/merge-patch+json", "If-Match", `"1"`))
+	assert.Equal(t, http.StatusForbidden, withKey(http.MethodDelete, "/cards/"+itoa(card.ID), nil, "If-Match", `"1"`))
+	assert.Equal(t, http.StatusForbidden, withKey(http.MethodGet, "/admin/api-keys", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, svc.do(http.MethodGet, "/cards/"+itoa(card.ID), nil, "X-API-Key", "mc_unknown").StatusCode)
+}
+
+func TestAPIKeyRevoked(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("cuddy", "dean2023", true)
+	card := a.addCard(a.addPatient("nasta", "nasta2023").ID)
+
+	admin := a.client()
+	require.Equal(t, http.StatusOK, admin.login("cuddy", "dean2023", entity.RoleDoctor).StatusCode)
+	k := createAPIKey(t, admin, entity.ScopeCardsRead)
+
+	require.Equal(t, http.StatusNoContent, admin.do(http.MethodDelete, "/admin/api-keys/"+itoa(k.ID), nil).StatusCode)
+
+	resp := a.client().do(http.MethodGet, "/cards/"+itoa(card.ID), nil, "X-API-Key", k.Key)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,211 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"medical-card/internal/api"
+	"medical-card/internal/app"
+	"medical-card/internal/entity"
+	service2 "medical-card/internal/service"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testAPI runs the whole HTTP API against an in-memory repository.
+type testAPI struct {
+	t    *testing.T
+	repo *memRepo
+	srv  *service2.PatientService
+	ts   *httptest.Server
+}
+
+// testOptions mirrors the defaults of app.Config, except that doctors may
+// skip 2FA so that tests do not have to enroll them.
+func testOptions() service2.Options {
+	return service2.Options{
+		Session: service2.SessionOptions{
+			TTL:         30 * time.Minute,
+			MaxLifetime: 12 * time.Hour,
+			Sliding:     true,
+		},
+		PasswordReset: service2.PasswordResetOptions{TTL: time.Hour},
+		LoginThrottle: service2.LoginThrottleOptions{
+			Window:             time.Hour,
+			FreeAttempts:       3,
+			LockoutThreshold:   10,
+			IPFreeAttempts:     20,
+			IPLockoutThreshold: 100,
+			BaseDelay:          time.Second,
+			MaxDelay:           5 * time.Minute,
+			LockoutDuration:    30 * time.Minute,
+		},
+		JWT: service2.JWTOptions{
+			Issuer:       "medical-card",
+			Audience:     "medical-card",
+			AccessTTL:    15 * time.Minute,
+			Keys:         map[string]string{"k1": "0123456789abcdef0123456789abcdef"},
+			SigningKeyID: "k1",
+		},
+		TOTP: service2.TOTPOptions{
+			Issuer:     "Medical Card",
+			PendingTTL: 5 * time.Minute,
+		},
+	}
+}
+
+func newTestAPI(t *testing.T, opts service2.Options) *testAPI {
+	repo := newMemRepo()
+	srv, err := service2.NewPatientService(repo, opts, service2.LogNotifier{})
+	require.NoError(t, err)
+
+	cookies, err := api.NewCookies(app.CookieConfig{Path: "/", SameSite: "lax"})
+	require.NoError(t, err)
+
+	s := api.NewServer("", time.Second, api.NewPatientHandler(srv, cookies), api.NewAuthMiddleware(srv, cookies))
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(ts.Close)
+
+	return &testAPI{t: t, repo: repo, srv: srv, ts: ts}
+}
+
+func (a *testAPI) hash(password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(a.t, err)
+
+	return string(h)
+}
+
+func (a *testAPI) addPatient(login, password string) entity.Patient {
+	p, err := a.repo.CreatePatient(context.Background(), entity.Patient{
+		FullName:       "Test Patient",
+		DateOfBorn:     time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC),
+		Address:        entity.Address{Country: "Belarus", City: "Vitebsk", Street: "Smolenskaya", Building: "11"},
+		PhoneNumber:    "1234567890",
+		PassportNumber: "BM" + strings.ToUpper(login),
+		Login:          login,
+		Password:       a.hash(password),
+	})
+	require.NoError(a.t, err)
+
+	return p
+}
+
+func (a *testAPI) addDoctor(login, password string, admin bool) entity.Doctor {
+	d, err := a.repo.CreateDoctor(context.Background(), entity.Doctor{
+		FullName: "Test Doctor",
+		Login:    login,
+		Password: a.hash(password),
+		IsAdmin:  admin,
+	})
+	require.NoError(a.t, err)
+
+	return d
+}
+
+func (a *testAPI) addCard(patientID int64) entity.Card {
+	c, err := a.repo.CreateCard(context.Background(), entity.Card{
+		PatientID:       patientID,
+		ChronicDiseases: entity.ChronicDiseases{"asthma"},
+		BloodType:       2,
+		RhFactor:        true,
+	})
+	require.NoError(a.t, err)
+
+	return c
+}
+
+// testClient is a browser-like client with its own cookie jar. It echoes
+// the CSRF cookie back the way the frontend does.
+type testClient struct {
+	a      *testAPI
+	client *http.Client
+}
+
+func (a *testAPI) client() *testClient {
+	jar, err := cookiejar.New(nil)
+	require.NoError(a.t, err)
+
+	return &testClient{
+		a: a,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+func (c *testClient) request(method, path string, body any) *http.Request {
+	var r io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		r = bytes.NewBufferString(b)
+	default:
+		buf, err := json.Marshal(b)
+		require.NoError(c.a.t, err)
+		r = bytes.NewReader(buf)
+	}
+
+	req, err := http.NewRequest(method, c.a.ts.URL+path, r)
+	require.NoError(c.a.t, err)
+
+	return req
+}
+
+func (c *testClient) send(req *http.Request) *http.Response {
+	resp, err := c.client.Do(req)
+	require.NoError(c.a.t, err)
+	c.a.t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func (c *testClient) cookie(name string) string {
+	u, err := url.Parse(c.a.ts.URL)
+	require.NoError(c.a.t, err)
+
+	for _, ck := range c.client.Jar.Cookies(u) {
+		if ck.Name == name {
+			return ck.Value
+		}
+	}
+
+	return ""
+}
+
+// do sends a request with the CSRF header set and the given extra headers.
+func (c *testClient) do(method, path string, body any, header ...string) *http.Response {
+	req := c.request(method, path, body)
+	req.Header.Set("X-CSRF-Token", c.cookie("csrf_token"))
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+
+	return c.send(req)
+}
+
+func (c *testClient) login(login, password string, role entity.Role) *http.Response {
+	return c.do(http.MethodPost, "/sessions", entity.Credentials{Login: login, Password: password, Role: role})
+}
+
+func decode(t *testing.T, resp *http.Response, v any) {
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+}
+
+func itoa(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPatchCardMergesFields(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("house", "vicodin42", false)
+	p := a.addPatient("nasta", "nasta2023")
+	card := a.addCard(p.ID)
+
+	c := a.client()
+	require.Equal(t, http.StatusOK, c.login("house", "vicodin42", entity.RoleDoctor).StatusCode)
+
+	resp := c.do(http.MethodPatch, "/cards/"+itoa(card.ID), `{"blood_type": 3, "chronic_diseases": null}`,
+		"Content-Type", "application/merge-patch+json", "If-Match", `"1"`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+	var got entity.Card
+	decode(t, resp, &got)
+	assert.Equal(t, p.ID, got.PatientID)
+	assert.Equal(t, 3, got.BloodType)
+	assert.True(t, got.RhFactor)
+	assert.Empty(t, got.ChronicDiseases)
+}
+
+func TestPatchCardKeepsPatient(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("house", "vicodin42", false)
+	p := a.addPatient("nasta", "nasta2023")
+	other := a.addPatient("olga", "olga2023")
+	card := a.addCard(p.ID)
+
+	c := a.client()
+	require.Equal(t, http.StatusOK, c.login("house", "vicodin42", entity.RoleDoctor).StatusCode)
+
+	for _, patch := range []string{`{"patient_id": ` + itoa(other.ID) + `}`, `{"patient_id": null}`} {
+		resp := c.do(http.MethodPatch, "/cards/"+itoa(card.ID), patch,
+			"Content-Type", "application/merge-patch+json", "If-Match", `"1"`)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, patch)
+	}
+
+	stored, err := a.repo.CardByID(context.Background(), card.ID)
+	require.NoError(t, err)
+	assert.Equal(t, p.ID, stored.PatientID)
+	assert.Equal(t, int64(1), stored.Version)
+}
+
+func TestPutCardKeepsPatient(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("house", "vicodin42", false)
+	p := a.addPatient("nasta", "nasta2023")
+	other := a.addPatient("olga", "olga2023")
+	card := a.addCard(p.ID)
+
+	c := a.client()
+	require.Equal(t, http.StatusOK, c.login("house", "vicodin42", entity.RoleDoctor).StatusCode)
+
+	for _, path := range []string{"/cards/", "/patients/cards/"} {
+		resp := c.do(http.MethodPut, path+itoa(card.ID), entity.Card{PatientID: other.ID, BloodType: 3}, "If-Match", `"1"`)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, path)
+	}
+
+	stored, err := a.repo.CardByID(context.Background(), card.ID)
+	require.NoError(t, err)
+	assert.Equal(t, p.ID, stored.PatientID)
+	assert.Equal(t, int64(1), stored.Version)
+
+	resp := c.do(http.MethodPut, "/cards/"+itoa(card.ID), entity.Card{PatientID: p.ID, BloodType: 3}, "If-Match", `"1"`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+}
@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCSRF(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	resp := c.login("nasta", "nasta2023", entity.RolePatient)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	for _, ck := range resp.Cookies() {
+		switch ck.Name {
+		case "ssid":
+			assert.True(t, ck.HttpOnly, "session cookie must be HttpOnly")
+		case "csrf_token":
+			assert.False(t, ck.HttpOnly, "CSRF cookie must be readable by scripts")
+		}
+	}
+	require.NotEmpty(t, c.cookie("csrf_token"))
+
+	// Safe methods do not need the header.
+	assert.Equal(t, http.StatusOK, c.send(c.request(http.MethodGet, "/me", nil)).StatusCode)
+
+	assert.Equal(t, http.StatusForbidden, c.send(c.request(http.MethodPost, "/sessions/refresh", nil)).StatusCode)
+	assert.Equal(t, http.StatusForbidden, c.do(http.MethodPost, "/sessions/refresh", nil, "X-CSRF-Token", "forged").StatusCode)
+	assert.Equal(t, http.StatusNoContent, c.do(http.MethodPost, "/sessions/refresh", nil).StatusCode)
+}
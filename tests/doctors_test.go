@@ -0,0 +1,37 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootstrapAdmin(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	admin := entity.Doctor{FullName: "Administrator", Specialization: "Administration", Login: "admin", Password: "admin2023"}
+
+	_, err := a.srv.BootstrapAdmin(context.Background(), entity.Doctor{Login: "admin", Password: "short"})
+	assert.Error(t, err)
+	assert.Empty(t, a.repo.doctors)
+
+	created, err := a.srv.BootstrapAdmin(context.Background(), admin)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	d, err := a.repo.DoctorByLogin(context.Background(), "admin")
+	require.NoError(t, err)
+	assert.True(t, d.IsAdmin)
+	assert.Equal(t, http.StatusOK, a.client().login("admin", "admin2023", entity.RoleDoctor).StatusCode)
+
+	// Later starts leave the doctors alone, even with other settings.
+	admin.Login, admin.Password = "root", "root2023"
+	created, err = a.srv.BootstrapAdmin(context.Background(), admin)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Len(t, a.repo.doctors, 1)
+}
@@ -0,0 +1,40 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"medical-card/internal/api"
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorsHideInternalDetails(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("house", "vicodin42", false)
+	p := a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	require.Equal(t, http.StatusOK, c.login("house", "vicodin42", entity.RoleDoctor).StatusCode)
+
+	resp := c.do(http.MethodGet, "/cards/4242", nil)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+
+	var problem api.Problem
+	decode(t, resp, &problem)
+	assert.Equal(t, "/problems/not-found", problem.Type)
+	assert.NotEmpty(t, problem.Detail)
+	assert.NotContains(t, problem.Detail, "4242")
+
+	// Validation errors still say which fields are wrong.
+	resp = c.do(http.MethodPost, "/cards", entity.Card{PatientID: p.ID, BloodType: 9})
+	require.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	problem = api.Problem{}
+	decode(t, resp, &problem)
+	require.NotEmpty(t, problem.Errors)
+	assert.Equal(t, "blood_type", problem.Errors[0].Field)
+}
@@ -0,0 +1,71 @@
+package tests
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginLockout(t *testing.T) {
+	opts := testOptions()
+	opts.LoginThrottle.BaseDelay = time.Minute
+	a := newTestAPI(t, opts)
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	for i := 0; i <= opts.LoginThrottle.FreeAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, c.login("nasta", "wrong2023", entity.RolePatient).StatusCode)
+	}
+
+	// The right password does not get through a lock either.
+	resp := c.login("nasta", "nasta2023", entity.RolePatient)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, 60, retryAfter, 1)
+}
+
+func TestLoginLockoutThreshold(t *testing.T) {
+	opts := testOptions()
+	opts.LoginThrottle.FreeAttempts = 100
+	opts.LoginThrottle.LockoutThreshold = 2
+	a := newTestAPI(t, opts)
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	c.login("nasta", "wrong2023", entity.RolePatient)
+	c.login("nasta", "wrong2023", entity.RolePatient)
+
+	resp := c.login("nasta", "nasta2023", entity.RolePatient)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	require.NoError(t, err)
+	assert.InDelta(t, opts.LoginThrottle.LockoutDuration.Seconds(), retryAfter, 1)
+}
+
+func TestUnlockAccount(t *testing.T) {
+	opts := testOptions()
+	opts.LoginThrottle.LockoutThreshold = 1
+	a := newTestAPI(t, opts)
+	a.addDoctor("cuddy", "dean2023", true)
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	c.login("nasta", "wrong2023", entity.RolePatient)
+	require.Equal(t, http.StatusTooManyRequests, c.login("nasta", "nasta2023", entity.RolePatient).StatusCode)
+
+	admin := a.client()
+	require.Equal(t, http.StatusOK, admin.login("cuddy", "dean2023", entity.RoleDoctor).StatusCode)
+	resp := admin.do(http.MethodPost, "/admin/unlock", entity.UnlockRequest{Login: "nasta", Role: entity.RolePatient})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.Equal(t, http.StatusOK, c.login("nasta", "nasta2023", entity.RolePatient).StatusCode)
+}
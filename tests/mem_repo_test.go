@@ -0,0 +1,675 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"medical-card/internal/entity"
+	service2 "medical-card/internal/service"
+
+	"github.com/google/uuid"
+)
+
+// memRepo is an in-memory service.PatientRepository for tests that do not
+// need Postgres. It keeps the semantics the service relies on, such as
+// conditional writes and single-use tokens, but has no real transactions.
+// Methods no test reaches are left to the embedded nil interface and panic.
+type memRepo struct {
+	service2.PatientRepository
+
+	mu         sync.Mutex
+	nextID     int64
+	patients   map[int64]entity.Patient
+	cards      map[int64]entity.Card
+	doctors    map[int64]entity.Doctor
+	sessions   map[uuid.UUID]entity.Session
+	resets     map[string]entity.PasswordReset
+	attempts   map[string]entity.LoginAttempt
+	apiKeys    map[int64]entity.APIKey
+	totps      map[string]entity.TOTP
+	recovery   map[string]map[string]bool
+	oidcLogins map[string]entity.OIDCLogin
+}
+
+func newMemRepo() *memRepo {
+	return &memRepo{
+		patients:   map[int64]entity.Patient{},
+		cards:      map[int64]entity.Card{},
+		doctors:    map[int64]entity.Doctor{},
+		sessions:   map[uuid.UUID]entity.Session{},
+		resets:     map[string]entity.PasswordReset{},
+		attempts:   map[string]entity.LoginAttempt{},
+		apiKeys:    map[int64]entity.APIKey{},
+		totps:      map[string]entity.TOTP{},
+		recovery:   map[string]map[string]bool{},
+		oidcLogins: map[string]entity.OIDCLogin{},
+	}
+}
+
+func (r *memRepo) WithTx(_ context.Context, fn func(repo service2.PatientRepository) error) error {
+	return fn(r)
+}
+
+func (r *memRepo) id() int64 {
+	r.nextID++
+	return r.nextID
+}
+
+func userKey(userID int64, role entity.Role) string {
+	return string(role) + ":" + strconv.FormatInt(userID, 10)
+}
+
+func notFound(kind string, key any) error {
+	return fmt.Errorf("%s %v: %w", kind, key, service2.ErrNotFound)
+}
+
+// Patient methods
+
+func (r *memRepo) CreatePatient(_ context.Context, p entity.Patient) (entity.Patient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.patients {
+		if other.Login == p.Login {
+			return p, &service2.ConstraintError{Field: "login", Err: service2.ErrAlreadyExists}
+		}
+		if other.PassportNumber == p.PassportNumber {
+			return p, &service2.ConstraintError{Field: "passport_number", Err: service2.ErrAlreadyExists}
+		}
+	}
+
+	p.ID = r.id()
+	p.Version = 1
+	p.EncryptedPassword = p.Password
+	p.Password = ""
+	r.patients[p.ID] = p
+
+	return p, nil
+}
+
+func (r *memRepo) PatientByID(_ context.Context, id int64) (entity.Patient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, ok := r.patients[id]
+	if !ok {
+		return p, notFound("patient", id)
+	}
+
+	return p, nil
+}
+
+func (r *memRepo) PatientByLogin(_ context.Context, login string) (entity.Patient, error) {
+	return r.findPatient(func(p entity.Patient) bool { return p.Login == login }, login)
+}
+
+func (r *memRepo) PatientByPassportNumber(_ context.Context, passNumber string) (entity.Patient, error) {
+	return r.findPatient(func(p entity.Patient) bool { return p.PassportNumber == passNumber }, passNumber)
+}
+
+func (r *memRepo) findPatient(match func(p entity.Patient) bool, key string) (entity.Patient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.patients {
+		if match(p) {
+			return p, nil
+		}
+	}
+
+	return entity.Patient{}, notFound("patient", key)
+}
+
+func (r *memRepo) LockPatient(ctx context.Context, id int64) error {
+	_, err := r.PatientByID(ctx, id)
+	return err
+}
+
+func (r *memRepo) UpdatePatient(_ context.Context, id int64, p entity.Patient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.patients[id]
+	if !ok || current.Version != p.Version {
+		return fmt.Errorf("patient with id %d: %w", id, service2.ErrVersionConflict)
+	}
+
+	p.EncryptedPassword = current.EncryptedPassword
+	p.Version++
+	r.patients[id] = p
+
+	return nil
+}
+
+func (r *memRepo) DeletePatient(_ context.Context, id, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.patients[id]
+	if !ok || current.Version != version {
+		return fmt.Errorf("patient with id %d: %w", id, service2.ErrVersionConflict)
+	}
+
+	delete(r.patients, id)
+
+	return nil
+}
+
+// Card methods
+
+func (r *memRepo) CreateCard(_ context.Context, c entity.Card) (entity.Card, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c.ID = r.id()
+	c.Version = 1
+	r.cards[c.ID] = c
+
+	return c, nil
+}
+
+func (r *memRepo) CardByID(_ context.Context, id int64) (entity.Card, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.cards[id]
+	if !ok {
+		return c, notFound("card", id)
+	}
+
+	return c, nil
+}
+
+func (r *memRepo) CardByPatientID(_ context.Context, patientID int64) (entity.Card, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.cards {
+		if c.PatientID == patientID {
+			return c, nil
+		}
+	}
+
+	return entity.Card{}, notFound("card of patient", patientID)
+}
+
+func (r *memRepo) UpdateCard(_ context.Context, id int64, c entity.Card) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.cards[id]
+	if !ok || current.Version != c.Version {
+		return fmt.Errorf("card with id %d: %w", id, service2.ErrVersionConflict)
+	}
+
+	c.Version++
+	r.cards[id] = c
+
+	return nil
+}
+
+func (r *memRepo) DeleteCard(_ context.Context, id, version int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current, ok := r.cards[id]
+	if !ok || current.Version != version {
+		return fmt.Errorf("card with id %d: %w", id, service2.ErrVersionConflict)
+	}
+
+	delete(r.cards, id)
+
+	return nil
+}
+
+// Doctor methods
+
+func (r *memRepo) CreateDoctor(_ context.Context, d entity.Doctor) (entity.Doctor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.doctors {
+		if other.Login == d.Login {
+			return d, &service2.ConstraintError{Field: "login", Err: service2.ErrAlreadyExists}
+		}
+		if d.OIDCSubject != nil && other.OIDCSubject != nil && *other.OIDCSubject == *d.OIDCSubject {
+			return d, &service2.ConstraintError{Field: "oidc_subject", Err: service2.ErrAlreadyExists}
+		}
+	}
+
+	d.ID = r.id()
+	d.EncryptedPassword = d.Password
+	d.Password = ""
+	r.doctors[d.ID] = d
+
+	return d, nil
+}
+
+func (r *memRepo) DoctorByID(_ context.Context, id int64) (entity.Doctor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.doctors[id]
+	if !ok {
+		return d, notFound("doctor", id)
+	}
+
+	return d, nil
+}
+
+func (r *memRepo) DoctorByLogin(_ context.Context, login string) (entity.Doctor, error) {
+	return r.findDoctor(func(d entity.Doctor) bool { return d.Login == login }, login)
+}
+
+func (r *memRepo) HasDoctors(_ context.Context) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.doctors) > 0, nil
+}
+
+func (r *memRepo) DoctorByOIDCSubject(_ context.Context, subject string) (entity.Doctor, error) {
+	return r.findDoctor(func(d entity.Doctor) bool { return d.OIDCSubject != nil && *d.OIDCSubject == subject }, subject)
+}
+
+func (r *memRepo) findDoctor(match func(d entity.Doctor) bool, key string) (entity.Doctor, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, d := range r.doctors {
+		if match(d) {
+			return d, nil
+		}
+	}
+
+	return entity.Doctor{}, notFound("doctor", key)
+}
+
+func (r *memRepo) UpdateDoctorIdentity(_ context.Context, d entity.Doctor) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	current := r.doctors[d.ID]
+	current.FullName = d.FullName
+	current.IsAdmin = d.IsAdmin
+	current.UpdatedAt = d.UpdatedAt
+	r.doctors[d.ID] = current
+
+	return nil
+}
+
+// Session methods
+
+func (r *memRepo) CreateSession(_ context.Context, sess entity.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sessions[sess.ID] = sess
+
+	return nil
+}
+
+func (r *memRepo) SessionByID(_ context.Context, id string) (entity.Session, error) {
+	sid, err := uuid.Parse(id)
+	if err != nil {
+		return entity.Session{}, notFound("session", id)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sess, ok := r.sessions[sid]
+	if !ok {
+		return sess, notFound("session", id)
+	}
+
+	return sess, nil
+}
+
+func (r *memRepo) SessionByRefreshToken(_ context.Context, hash string) (entity.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, sess := range r.sessions {
+		if hash != "" && sess.RefreshTokenHash == hash {
+			return sess, nil
+		}
+	}
+
+	return entity.Session{}, notFound("session", "by refresh token")
+}
+
+func (r *memRepo) SessionByTokenID(_ context.Context, tokenID string) (entity.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, sess := range r.sessions {
+		if tokenID != "" && sess.TokenID == tokenID {
+			return sess, nil
+		}
+	}
+
+	return entity.Session{}, notFound("session", "by token id")
+}
+
+func (r *memRepo) UpdateSessionRefreshToken(_ context.Context, id uuid.UUID, tokenID, oldHash, newHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sess, ok := r.sessions[id]
+	if !ok || sess.RefreshTokenHash != oldHash {
+		return notFound("session", id)
+	}
+
+	sess.TokenID = tokenID
+	sess.RefreshTokenHash = newHash
+	r.sessions[id] = sess
+
+	return nil
+}
+
+func (r *memRepo) UpdateSessionExpiry(_ context.Context, id uuid.UUID, expiredAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sess := r.sessions[id]
+	sess.ExpiredAt = expiredAt
+	r.sessions[id] = sess
+
+	return nil
+}
+
+func (r *memRepo) DeleteSession(_ context.Context, id string) error {
+	sid, err := uuid.Parse(id)
+	if err != nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.sessions, sid)
+
+	return nil
+}
+
+func (r *memRepo) DeleteUserSessions(_ context.Context, userID int64, role entity.Role) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, sess := range r.sessions {
+		if sess.UserID == userID && sess.Role == role {
+			delete(r.sessions, id)
+		}
+	}
+
+	return nil
+}
+
+// Password methods
+
+func (r *memRepo) UpdatePassword(_ context.Context, userID int64, role entity.Role, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch role {
+	case entity.RolePatient:
+		p := r.patients[userID]
+		p.EncryptedPassword = hash
+		r.patients[userID] = p
+	case entity.RoleDoctor:
+		d := r.doctors[userID]
+		d.EncryptedPassword = hash
+		r.doctors[userID] = d
+	}
+
+	return nil
+}
+
+func (r *memRepo) CreatePasswordReset(_ context.Context, pr entity.PasswordReset) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resets[pr.TokenHash] = pr
+
+	return nil
+}
+
+func (r *memRepo) UsePasswordReset(_ context.Context, tokenHash string, now time.Time) (entity.PasswordReset, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pr, ok := r.resets[tokenHash]
+	if !ok || pr.UsedAt != nil || !pr.ExpiredAt.After(now) {
+		return pr, service2.ErrNotFound
+	}
+
+	pr.UsedAt = &now
+	r.resets[tokenHash] = pr
+
+	return pr, nil
+}
+
+// Login attempt methods
+
+func (r *memRepo) LoginAttempts(_ context.Context, keys []string) ([]entity.LoginAttempt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var attempts []entity.LoginAttempt
+	for _, key := range keys {
+		if a, ok := r.attempts[key]; ok {
+			attempts = append(attempts, a)
+		}
+	}
+
+	return attempts, nil
+}
+
+func (r *memRepo) RecordLoginFailure(_ context.Context, key string, now, windowStart time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a, ok := r.attempts[key]
+	if !ok || a.LastFailureAt.Before(windowStart) {
+		a = entity.LoginAttempt{Key: key, LockedUntil: a.LockedUntil}
+	}
+
+	a.Failures++
+	a.LastFailureAt = now
+	r.attempts[key] = a
+
+	return a.Failures, nil
+}
+
+func (r *memRepo) LockLogin(_ context.Context, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := r.attempts[key]
+	a.LockedUntil = &until
+	r.attempts[key] = a
+
+	return nil
+}
+
+func (r *memRepo) DeleteLoginAttempts(_ context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.attempts, key)
+
+	return nil
+}
+
+// API key methods
+
+func (r *memRepo) CreateAPIKey(_ context.Context, k entity.APIKey) (entity.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k.ID = r.id()
+	r.apiKeys[k.ID] = k
+
+	return k, nil
+}
+
+func (r *memRepo) APIKeyByHash(_ context.Context, hash string) (entity.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, k := range r.apiKeys {
+		if k.KeyHash == hash {
+			return k, nil
+		}
+	}
+
+	return entity.APIKey{}, notFound("api key", "by hash")
+}
+
+func (r *memRepo) RevokeAPIKey(_ context.Context, id int64, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k, ok := r.apiKeys[id]
+	if !ok || k.RevokedAt != nil {
+		return notFound("active api key", id)
+	}
+
+	k.RevokedAt = &now
+	r.apiKeys[id] = k
+
+	return nil
+}
+
+func (r *memRepo) TouchAPIKey(_ context.Context, id int64, now time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	k := r.apiKeys[id]
+	k.LastUsedAt = &now
+	r.apiKeys[id] = k
+
+	return nil
+}
+
+// Two-factor methods
+
+func (r *memRepo) TOTPByUser(_ context.Context, userID int64, role entity.Role) (entity.TOTP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.totps[userKey(userID, role)]
+	if !ok {
+		return t, notFound("totp", userKey(userID, role))
+	}
+
+	return t, nil
+}
+
+func (r *memRepo) SaveTOTP(_ context.Context, t entity.TOTP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := userKey(t.UserID, t.Role)
+	if current, ok := r.totps[key]; ok && current.EnabledAt != nil {
+		return fmt.Errorf("totp of %s: %w", key, service2.ErrAlreadyExists)
+	}
+
+	r.totps[key] = t
+
+	return nil
+}
+
+func (r *memRepo) EnableTOTP(_ context.Context, userID int64, role entity.Role, enabledAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := userKey(userID, role)
+	t := r.totps[key]
+	t.EnabledAt = &enabledAt
+	r.totps[key] = t
+
+	return nil
+}
+
+func (r *memRepo) UseTOTPStep(_ context.Context, userID int64, role entity.Role, step int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := userKey(userID, role)
+	t := r.totps[key]
+	if t.LastUsedStep >= step {
+		return fmt.Errorf("totp of %s: %w", key, service2.ErrConflict)
+	}
+
+	t.LastUsedStep = step
+	r.totps[key] = t
+
+	return nil
+}
+
+func (r *memRepo) DeleteTOTP(_ context.Context, userID int64, role entity.Role) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.totps, userKey(userID, role))
+	delete(r.recovery, userKey(userID, role))
+
+	return nil
+}
+
+func (r *memRepo) ReplaceRecoveryCodes(_ context.Context, userID int64, role entity.Role, hashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	codes := map[string]bool{}
+	for _, h := range hashes {
+		codes[h] = false
+	}
+	r.recovery[userKey(userID, role)] = codes
+
+	return nil
+}
+
+func (r *memRepo) UseRecoveryCode(_ context.Context, userID int64, role entity.Role, hash string, _ time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	codes := r.recovery[userKey(userID, role)]
+	used, ok := codes[hash]
+	if !ok || used {
+		return notFound("recovery code", userKey(userID, role))
+	}
+
+	codes[hash] = true
+
+	return nil
+}
+
+// Single sign-on methods
+
+func (r *memRepo) CreateOIDCLogin(_ context.Context, l entity.OIDCLogin) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.oidcLogins[l.StateHash] = l
+
+	return nil
+}
+
+func (r *memRepo) UseOIDCLogin(_ context.Context, stateHash string, now time.Time) (entity.OIDCLogin, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	l, ok := r.oidcLogins[stateHash]
+	delete(r.oidcLogins, stateHash)
+	if !ok || !l.ExpiredAt.After(now) {
+		return l, service2.ErrNotFound
+	}
+
+	return l, nil
+}
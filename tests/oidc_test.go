@@ -0,0 +1,280 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	service2 "medical-card/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	stubClientID    = "medical-card"
+	stubRedirectURL = "http://localhost/oidc/callback"
+	stubCode        = "auth-code"
+)
+
+// stubIdP is a minimal OpenID Connect provider. It hands out the ID token
+// built by claims for stubCode if the PKCE verifier matches the challenge
+// of the last authorization request. Its key set lists extraKeys before the
+// signing key.
+type stubIdP struct {
+	t         *testing.T
+	srv       *httptest.Server
+	challenge string
+	claims    func(nonce string) map[string]any
+	nonce     string
+	signWith  *rsa.PrivateKey
+	extraKeys []map[string]string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	idp := &stubIdP{t: t, signWith: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.srv.URL,
+			"authorization_endpoint": idp.srv.URL + "/authorize",
+			"token_endpoint":         idp.srv.URL + "/token",
+			"jwks_uri":               idp.srv.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"keys": append(idp.extraKeys, map[string]string{
+				"kty": "RSA",
+				"kid": "k1",
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}),
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.PostForm.Get("grant_type") != "authorization_code" ||
+			r.PostForm.Get("code") != stubCode ||
+			r.PostForm.Get("redirect_uri") != stubRedirectURL ||
+			base64.RawURLEncoding.EncodeToString(sum[:]) != idp.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "opaque",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(idp.claims(idp.nonce)),
+		})
+	})
+
+	idp.srv = httptest.NewServer(mux)
+	t.Cleanup(idp.srv.Close)
+
+	idp.claims = func(nonce string) map[string]any {
+		now := time.Now()
+
+		return map[string]any{
+			"iss":                idp.srv.URL,
+			"sub":                "staff-42",
+			"aud":                stubClientID,
+			"iat":                now.Unix(),
+			"exp":                now.Add(5 * time.Minute).Unix(),
+			"nonce":              nonce,
+			"name":               "Gregory House",
+			"preferred_username": "ghouse",
+			"amr":                []string{"pwd", "otp"},
+			"realm_access":       map[string]any{"roles": []string{"doctor", "admin"}},
+		}
+	}
+
+	return idp
+}
+
+func (idp *stubIdP) sign(claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "k1"})
+	require.NoError(idp.t, err)
+
+	payload, err := json.Marshal(claims)
+	require.NoError(idp.t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.signWith, crypto.SHA256, digest[:])
+	require.NoError(idp.t, err)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *stubIdP) provider() *service2.OIDCProvider {
+	return service2.NewOIDCProvider(service2.OIDCOptions{
+		Issuer:      idp.srv.URL,
+		ClientID:    stubClientID,
+		RedirectURL: stubRedirectURL,
+		Scopes:      []string{"openid", "profile"},
+		RolesClaim:  "realm_access.roles",
+	}, idp.srv.Client())
+}
+
+// authorize plays the browser: it follows the authorization URL far enough
+// for the stub to record the PKCE challenge and nonce.
+func (idp *stubIdP) authorize(p *service2.OIDCProvider, verifier string) {
+	authURL, err := p.AuthCodeURL(context.Background(), "state", "nonce-1", verifier)
+	require.NoError(idp.t, err)
+
+	u, err := url.Parse(authURL)
+	require.NoError(idp.t, err)
+
+	q := u.Query()
+	assert.Equal(idp.t, idp.srv.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(idp.t, "code", q.Get("response_type"))
+	assert.Equal(idp.t, stubClientID, q.Get("client_id"))
+	assert.Equal(idp.t, "openid profile", q.Get("scope"))
+	assert.Equal(idp.t, "S256", q.Get("code_challenge_method"))
+
+	idp.challenge = q.Get("code_challenge")
+	idp.nonce = q.Get("nonce")
+}
+
+func TestOIDCExchange(t *testing.T) {
+	idp := newStubIdP(t)
+	p := idp.provider()
+
+	idp.authorize(p, "verifier-0123456789-0123456789-0123456789")
+
+	id, err := p.Exchange(context.Background(), stubCode, "verifier-0123456789-0123456789-0123456789", "nonce-1")
+	require.NoError(t, err)
+
+	assert.Equal(t, "staff-42", id.Subject)
+	assert.Equal(t, "ghouse", id.Login)
+	assert.Equal(t, "Gregory House", id.FullName)
+	assert.Equal(t, []string{"doctor", "admin"}, id.Roles)
+	assert.True(t, id.MFA)
+}
+
+// A provider may publish keys we cannot use next to its signing key.
+func TestOIDCExchangeSkipsUnusableKeys(t *testing.T) {
+	const verifier = "verifier-0123456789-0123456789-0123456789"
+
+	idp := newStubIdP(t)
+	idp.extraKeys = []map[string]string{
+		{"kty": "RSA", "kid": "short", "use": "sig", "n": "AQAB", "e": "AQAB"},
+		{"kty": "RSA", "kid": "garbled", "use": "sig", "n": "!!", "e": "AQAB"},
+		{"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256"},
+	}
+	p := idp.provider()
+
+	idp.authorize(p, verifier)
+
+	id, err := p.Exchange(context.Background(), stubCode, verifier, "nonce-1")
+	require.NoError(t, err)
+	assert.Equal(t, "staff-42", id.Subject)
+}
+
+func TestOIDCExchangeRejects(t *testing.T) {
+	const verifier = "verifier-0123456789-0123456789-0123456789"
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		verifier string
+		nonce    string
+		setup    func(idp *stubIdP)
+	}{
+		{
+			name:     "wrong PKCE verifier",
+			verifier: "another-verifier-0123456789-0123456789",
+			nonce:    "nonce-1",
+		},
+		{
+			name:     "nonce mismatch",
+			verifier: verifier,
+			nonce:    "nonce-2",
+		},
+		{
+			name:     "foreign audience",
+			verifier: verifier,
+			nonce:    "nonce-1",
+			setup: func(idp *stubIdP) {
+				claims := idp.claims
+				idp.claims = func(nonce string) map[string]any {
+					c := claims(nonce)
+					c["aud"] = []string{"someone-else"}
+					return c
+				}
+			},
+		},
+		{
+			name:     "expired token",
+			verifier: verifier,
+			nonce:    "nonce-1",
+			setup: func(idp *stubIdP) {
+				claims := idp.claims
+				idp.claims = func(nonce string) map[string]any {
+					c := claims(nonce)
+					c["exp"] = time.Now().Add(-time.Hour).Unix()
+					return c
+				}
+			},
+		},
+		{
+			name:     "wrong issuer",
+			verifier: verifier,
+			nonce:    "nonce-1",
+			setup: func(idp *stubIdP) {
+				claims := idp.claims
+				idp.claims = func(nonce string) map[string]any {
+					c := claims(nonce)
+					c["iss"] = "https://evil.example"
+					return c
+				}
+			},
+		},
+		{
+			name:     "signed by unknown key",
+			verifier: verifier,
+			nonce:    "nonce-1",
+			setup: func(idp *stubIdP) {
+				idp.signWith = otherKey
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newStubIdP(t)
+			if tt.setup != nil {
+				tt.setup(idp)
+			}
+
+			p := idp.provider()
+			idp.authorize(p, verifier)
+
+			_, err := p.Exchange(context.Background(), stubCode, tt.verifier, tt.nonce)
+			assert.ErrorIs(t, err, service2.ErrUnauthorized)
+		})
+	}
+}
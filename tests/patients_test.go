@@ -2,6 +2,7 @@ package tests
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -31,8 +32,11 @@ func TestAddPatient(t *testing.T) {
 	db, err := app.NewPostgresClient(c.Database)
 	require.NoError(t, err)
 	repo := dal.NewPatientRepository(db)
-	service := service2.NewPatientService(repo)
-	handler := api.NewPatientHandler(service)
+	service, err := service2.NewPatientService(repo, testOptions(), service2.LogNotifier{})
+	require.NoError(t, err)
+	cookies, err := api.NewCookies(c.Cookie)
+	require.NoError(t, err)
+	handler := api.NewPatientHandler(service, cookies)
 
 	payload := entity.Patient{
 		FullName:   "test test",
@@ -47,6 +51,7 @@ func TestAddPatient(t *testing.T) {
 		PhoneNumber:    "1234567890",
 		PassportNumber: "BM1234567",
 		Login:          "@Nasta",
+		Password:       "nasta2023",
 	}
 
 	jsonPayload, err := json.Marshal(payload)
@@ -67,3 +72,71 @@ func TestAddPatient(t *testing.T) {
 	assert.NotZero(t, resp.ID)
 	assert.False(t, resp.CreatedAt.IsZero())
 }
+
+func TestPatientsRejectsTamperedCursor(t *testing.T) {
+	cookies, err := api.NewCookies(app.CookieConfig{})
+	require.NoError(t, err)
+	service, err := service2.NewPatientService(nil, testOptions(), service2.LogNotifier{})
+	require.NoError(t, err)
+	handler := api.NewPatientHandler(service, cookies)
+
+	cursors := []entity.PatientCursor{
+		{Sort: entity.PatientSortCreatedAt, Value: "yesterday", ID: 1},
+		{Sort: entity.PatientSortDateOfBorn, Value: "1990-13-45", ID: 1},
+		{Sort: entity.PatientSortFullName, Value: "a\x00b", ID: 1},
+	}
+
+	for _, c := range cursors {
+		b, err := json.Marshal(c)
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/patients?sort="+string(c.Sort)+"&after="+base64.RawURLEncoding.EncodeToString(b), nil)
+
+		handler.Patients(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code, c.Value)
+	}
+}
+
+func TestPatchPatientIsConditional(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("house", "vicodin42", false)
+	p := a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	require.Equal(t, http.StatusOK, c.login("house", "vicodin42", entity.RoleDoctor).StatusCode)
+
+	patch := func(header ...string) *http.Response {
+		return c.do(http.MethodPatch, "/patients/"+itoa(p.ID), `{"phone_number": "375291234567"}`,
+			append([]string{"Content-Type", "application/merge-patch+json"}, header...)...)
+	}
+
+	assert.Equal(t, http.StatusPreconditionRequired, patch().StatusCode)
+	assert.Equal(t, http.StatusPreconditionRequired, patch("If-Match", "*").StatusCode)
+	assert.Equal(t, http.StatusPreconditionFailed, patch("If-Match", `"7"`).StatusCode)
+
+	resp := patch("If-Match", `"1"`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, `"2"`, resp.Header.Get("ETag"))
+
+	assert.Equal(t, http.StatusPreconditionFailed, patch("If-Match", `"1"`).StatusCode)
+}
+
+func TestDeleteCardIsConditional(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addDoctor("house", "vicodin42", false)
+	card := a.addCard(a.addPatient("nasta", "nasta2023").ID)
+
+	c := a.client()
+	require.Equal(t, http.StatusOK, c.login("house", "vicodin42", entity.RoleDoctor).StatusCode)
+
+	resp := c.do(http.MethodGet, "/cards/"+itoa(card.ID), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, `"1"`, etag)
+
+	assert.Equal(t, http.StatusPreconditionRequired, c.do(http.MethodDelete, "/cards/"+itoa(card.ID), nil).StatusCode)
+	assert.Equal(t, http.StatusOK, c.do(http.MethodDelete, "/cards/"+itoa(card.ID), nil, "If-Match", etag).StatusCode)
+	assert.Equal(t, http.StatusNotFound, c.do(http.MethodDelete, "/cards/"+itoa(card.ID), nil, "If-Match", etag).StatusCode)
+}
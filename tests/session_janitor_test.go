@@ -0,0 +1,38 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	service2 "medical-card/internal/service"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewSessionJanitorRejectsBadSettings(t *testing.T) {
+	_, err := service2.NewSessionJanitor(nil, 0, 100)
+	assert.Error(t, err)
+
+	_, err = service2.NewSessionJanitor(nil, -time.Minute, 100)
+	assert.Error(t, err)
+
+	_, err = service2.NewSessionJanitor(nil, time.Minute, 0)
+	assert.Error(t, err)
+
+	j, err := service2.NewSessionJanitor(nil, time.Minute, 100)
+	assert.NoError(t, err)
+	assert.NotNil(t, j)
+}
+
+func TestNewPatientServiceRejectsBadSessionLifetimes(t *testing.T) {
+	for _, s := range []service2.SessionOptions{
+		{TTL: 0, MaxLifetime: time.Hour},
+		{TTL: time.Minute, MaxLifetime: -time.Hour},
+		{TTL: 2 * time.Hour, MaxLifetime: time.Hour},
+	} {
+		opts := testOptions()
+		opts.Session = s
+		_, err := service2.NewPatientService(newMemRepo(), opts, service2.LogNotifier{})
+		assert.Error(t, err, "%+v", s)
+	}
+}
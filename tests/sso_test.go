@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"medical-card/internal/entity"
+	service2 "medical-card/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (idp *stubIdP) options() service2.Options {
+	opts := testOptions()
+	opts.OIDC = service2.OIDCOptions{
+		Issuer:      idp.srv.URL,
+		ClientID:    stubClientID,
+		RedirectURL: stubRedirectURL,
+		Scopes:      []string{"openid", "profile"},
+		RolesClaim:  "realm_access.roles",
+		DoctorRole:  "doctor",
+		AdminRole:   "admin",
+		LoginTTL:    10 * time.Minute,
+		HTTPTimeout: 5 * time.Second,
+	}
+
+	return opts
+}
+
+// withRoles makes the provider grant roles instead of the default ones.
+func (idp *stubIdP) withRoles(roles ...string) {
+	claims := idp.claims
+	idp.claims = func(nonce string) map[string]any {
+		c := claims(nonce)
+		c["realm_access"] = map[string]any{"roles": roles}
+		return c
+	}
+}
+
+// startSSO begins a login like a browser and lets the stub provider see the
+// authorization request. It returns the state the provider sends back.
+func startSSO(t *testing.T, c *testClient, idp *stubIdP, returnTo string) string {
+	resp := c.do(http.MethodGet, "/oidc/login?return_to="+url.QueryEscape(returnTo), nil)
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	require.NotEmpty(t, c.cookie("oidc_state"))
+
+	u, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, idp.srv.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+
+	q := u.Query()
+	idp.challenge = q.Get("code_challenge")
+	idp.nonce = q.Get("nonce")
+
+	return q.Get("state")
+}
+
+func ssoCallback(c *testClient, state string) *http.Response {
+	return c.do(http.MethodGet, "/oidc/callback?code="+stubCode+"&state="+url.QueryEscape(state), nil)
+}
+
+func ssoDoctor(t *testing.T, a *testAPI) entity.Doctor {
+	d, err := a.repo.DoctorByOIDCSubject(context.Background(), "staff-42")
+	require.NoError(t, err)
+
+	return d
+}
+
+func TestSSOLogin(t *testing.T) {
+	idp := newStubIdP(t)
+	a := newTestAPI(t, idp.options())
+
+	c := a.client()
+	resp := ssoCallback(c, startSSO(t, c, idp, "/cards?limit=5"))
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/cards?limit=5", resp.Header.Get("Location"))
+	assert.Empty(t, c.cookie("oidc_state"))
+
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, "/me", nil).StatusCode)
+
+	d := ssoDoctor(t, a)
+	assert.Equal(t, "ghouse", d.Login)
+	assert.Equal(t, "Gregory House", d.FullName)
+	assert.NotEmpty(t, d.Specialization)
+	assert.True(t, d.IsAdmin)
+
+	// Roles are taken from the provider on every login.
+	idp.withRoles("doctor")
+	c = a.client()
+	require.Equal(t, http.StatusSeeOther, ssoCallback(c, startSSO(t, c, idp, "/")).StatusCode)
+
+	d2 := ssoDoctor(t, a)
+	assert.Equal(t, d.ID, d2.ID)
+	assert.False(t, d2.IsAdmin)
+	assert.Equal(t, http.StatusForbidden, c.do(http.MethodGet, "/admin/api-keys", nil).StatusCode)
+}
+
+func TestSSORequiresDoctorRole(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.withRoles("nurse", "admin")
+	a := newTestAPI(t, idp.options())
+
+	c := a.client()
+	resp := ssoCallback(c, startSSO(t, c, idp, "/"))
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Empty(t, c.cookie("ssid"))
+	assert.Empty(t, a.repo.doctors)
+}
+
+func TestSSOStateBoundToBrowser(t *testing.T) {
+	idp := newStubIdP(t)
+	a := newTestAPI(t, idp.options())
+
+	victim := a.client()
+	state := startSSO(t, victim, idp, "/")
+
+	// Someone else's browser cannot finish the login...
+	attacker := a.client()
+	assert.Equal(t, http.StatusUnauthorized, ssoCallback(attacker, state).StatusCode)
+
+	// ...and the browser that started it only with its own state.
+	assert.Equal(t, http.StatusUnauthorized, ssoCallback(victim, "forged").StatusCode)
+	assert.Empty(t, a.repo.doctors)
+}
+
+func TestSSOStateSingleUse(t *testing.T) {
+	idp := newStubIdP(t)
+	a := newTestAPI(t, idp.options())
+
+	c := a.client()
+	state := startSSO(t, c, idp, "/")
+	require.Equal(t, http.StatusSeeOther, ssoCallback(c, state).StatusCode)
+
+	req := c.request(http.MethodGet, "/oidc/callback?code="+stubCode+"&state="+url.QueryEscape(state), nil)
+	req.AddCookie(&http.Cookie{Name: "oidc_state", Value: state})
+	assert.Equal(t, http.StatusUnauthorized, a.client().send(req).StatusCode)
+}
+
+func TestSSOReturnTo(t *testing.T) {
+	idp := newStubIdP(t)
+	a := newTestAPI(t, idp.options())
+
+	for _, returnTo := range []string{"https://evil.example/", "//evil.example/", "/\\evil.example", "cards"} {
+		c := a.client()
+		resp := c.do(http.MethodGet, "/oidc/login?return_to="+url.QueryEscape(returnTo), nil)
+		assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode, returnTo)
+		assert.Empty(t, c.cookie("oidc_state"), returnTo)
+	}
+
+	c := a.client()
+	resp := ssoCallback(c, startSSO(t, c, idp, ""))
+	require.Equal(t, http.StatusSeeOther, resp.StatusCode)
+	assert.Equal(t, "/", resp.Header.Get("Location"))
+}
+
+func TestSSOLoginClash(t *testing.T) {
+	idp := newStubIdP(t)
+	a := newTestAPI(t, idp.options())
+	local := a.addDoctor("ghouse", "vicodin42", false)
+
+	c := a.client()
+	require.Equal(t, http.StatusSeeOther, ssoCallback(c, startSSO(t, c, idp, "/")).StatusCode)
+
+	d := ssoDoctor(t, a)
+	assert.NotEqual(t, local.ID, d.ID)
+	assert.Equal(t, "oidc-staff-42", d.Login)
+
+	// The local account is not taken over and keeps working.
+	assert.Equal(t, http.StatusOK, a.client().login("ghouse", "vicodin42", entity.RoleDoctor).StatusCode)
+}
+
+func TestSSODoctorHasNoPassword(t *testing.T) {
+	idp := newStubIdP(t)
+	a := newTestAPI(t, idp.options())
+
+	c := a.client()
+	require.Equal(t, http.StatusSeeOther, ssoCallback(c, startSSO(t, c, idp, "/")).StatusCode)
+
+	d := ssoDoctor(t, a)
+	require.NoError(t, a.repo.UpdatePassword(context.Background(), d.ID, entity.RoleDoctor, a.hash("guessed2023")))
+
+	assert.Equal(t, http.StatusUnauthorized, a.client().login("ghouse", "guessed2023", entity.RoleDoctor).StatusCode)
+
+	resp := a.client().do(http.MethodPost, "/password-resets", entity.PasswordResetRequest{Login: "ghouse", Role: entity.RoleDoctor})
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Empty(t, a.repo.resets)
+}
+
+func TestSSOInvalidProviderLogin(t *testing.T) {
+	idp := newStubIdP(t)
+	claims := idp.claims
+	idp.claims = func(nonce string) map[string]any {
+		c := claims(nonce)
+		c["preferred_username"] = "Gregory House"
+		return c
+	}
+	a := newTestAPI(t, idp.options())
+
+	c := a.client()
+	require.Equal(t, http.StatusSeeOther, ssoCallback(c, startSSO(t, c, idp, "/")).StatusCode)
+	assert.Equal(t, "oidc-staff-42", ssoDoctor(t, a).Login)
+}
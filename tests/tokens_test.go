@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+
+	"medical-card/internal/entity"
+	service2 "medical-card/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func issueTokens(t *testing.T, c *testClient, login, password string, role entity.Role) entity.TokenPair {
+	resp := c.do(http.MethodPost, "/tokens", entity.Credentials{Login: login, Password: password, Role: role})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	var pair entity.TokenPair
+	decode(t, resp, &pair)
+	require.NotEmpty(t, pair.AccessToken)
+	require.NotEmpty(t, pair.RefreshToken)
+
+	return pair
+}
+
+func refreshTokens(c *testClient, refreshToken string) *http.Response {
+	return c.do(http.MethodPost, "/tokens/refresh", map[string]string{"refresh_token": refreshToken})
+}
+
+func bearer(c *testClient, method, path, token string) *http.Response {
+	return c.do(method, path, nil, "Authorization", "Bearer "+token)
+}
+
+func TestTokensIssueAndRefresh(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	pair := issueTokens(t, c, "nasta", "nasta2023", entity.RolePatient)
+	assert.Equal(t, "Bearer", pair.TokenType)
+	assert.Equal(t, http.StatusOK, bearer(c, http.MethodGet, "/me", pair.AccessToken).StatusCode)
+
+	resp := refreshTokens(c, pair.RefreshToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var next entity.TokenPair
+	decode(t, resp, &next)
+	assert.NotEqual(t, pair.RefreshToken, next.RefreshToken)
+	assert.Equal(t, http.StatusOK, bearer(c, http.MethodGet, "/me", next.AccessToken).StatusCode)
+
+	// A refresh token works once.
+	assert.Equal(t, http.StatusUnauthorized, refreshTokens(c, pair.RefreshToken).StatusCode)
+	assert.Equal(t, http.StatusOK, refreshTokens(c, next.RefreshToken).StatusCode)
+}
+
+func TestTokensRevokedWithSession(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	pair := issueTokens(t, c, "nasta", "nasta2023", entity.RolePatient)
+
+	require.Equal(t, http.StatusNoContent, bearer(c, http.MethodDelete, "/sessions", pair.AccessToken).StatusCode)
+
+	assert.Equal(t, http.StatusUnauthorized, bearer(c, http.MethodGet, "/me", pair.AccessToken).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, refreshTokens(c, pair.RefreshToken).StatusCode)
+}
+
+func TestTokensRejectTampering(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	pair := issueTokens(t, c, "nasta", "nasta2023", entity.RolePatient)
+	parts := strings.Split(pair.AccessToken, ".")
+	require.Len(t, parts, 3)
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	require.NoError(t, err)
+	forged := strings.Replace(string(payload), `"role":"patient"`, `"role":"doctor"`, 1)
+	require.NotEqual(t, string(payload), forged)
+
+	tokens := []string{
+		parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(forged)) + "." + parts[2],
+		parts[0] + "." + parts[1] + ".",
+		"garbage",
+	}
+	for _, token := range tokens {
+		resp := bearer(c, http.MethodGet, "/me", token)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, token)
+		assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "invalid_token")
+	}
+}
+
+// The session id is the value of the session cookie, so neither may leak
+// into tokens or let a bearer session in through the cookie.
+func TestTokensDoNotExposeSessionCookie(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	pair := issueTokens(t, c, "nasta", "nasta2023", entity.RolePatient)
+
+	require.Len(t, a.repo.sessions, 1)
+	for id := range a.repo.sessions {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.Split(pair.AccessToken, ".")[1])
+		require.NoError(t, err)
+		assert.NotContains(t, string(payload), id.String())
+
+		req := c.request(http.MethodGet, "/me", nil)
+		req.AddCookie(&http.Cookie{Name: "ssid", Value: id.String()})
+		assert.Equal(t, http.StatusUnauthorized, c.send(req).StatusCode)
+	}
+}
+
+func TestNewPatientServiceChecksJWTKeys(t *testing.T) {
+	short := testOptions()
+	short.JWT.Keys = map[string]string{"k1": "too-short"}
+
+	missing := testOptions()
+	missing.JWT.SigningKeyID = "k2"
+
+	for name, opts := range map[string]service2.Options{"short key": short, "missing signing key": missing} {
+		_, err := service2.NewPatientService(newMemRepo(), opts, service2.LogNotifier{})
+		assert.Error(t, err, name)
+	}
+}
+
+func TestTokensOffWithoutKeys(t *testing.T) {
+	opts := testOptions()
+	opts.JWT.Keys = nil
+	opts.JWT.SigningKeyID = ""
+	a := newTestAPI(t, opts)
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	resp := c.do(http.MethodPost, "/tokens", entity.Credentials{Login: "nasta", Password: "nasta2023", Role: entity.RolePatient})
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, a.repo.sessions)
+
+	assert.Equal(t, http.StatusNotFound, refreshTokens(c, "whatever").StatusCode)
+
+	require.Equal(t, http.StatusOK, c.login("nasta", "nasta2023", entity.RolePatient).StatusCode)
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, "/me", nil).StatusCode)
+}
+
+func TestTokensChangePassword(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	pair := issueTokens(t, c, "nasta", "nasta2023", entity.RolePatient)
+
+	resp := c.do(http.MethodPost, "/me/password", entity.PasswordChange{OldPassword: "nasta2023", NewPassword: "nasta2024"},
+		"Authorization", "Bearer "+pair.AccessToken)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, resp.Header.Values("Set-Cookie"))
+
+	var next entity.TokenPair
+	decode(t, resp, &next)
+	require.NotEmpty(t, next.AccessToken)
+
+	assert.Equal(t, http.StatusUnauthorized, bearer(c, http.MethodGet, "/me", pair.AccessToken).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, refreshTokens(c, pair.RefreshToken).StatusCode)
+	assert.Equal(t, http.StatusOK, bearer(c, http.MethodGet, "/me", next.AccessToken).StatusCode)
+	assert.Equal(t, http.StatusOK, refreshTokens(c, next.RefreshToken).StatusCode)
+}
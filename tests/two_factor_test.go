@@ -0,0 +1,229 @@
+package tests
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"medical-card/internal/entity"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// totpCode computes the code an authenticator shows for secret at t.
+func totpCode(t *testing.T, secret string, at time.Time) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(at.Unix()/30))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// enableTOTP enrolls and confirms 2FA for the client's user and returns the
+// enrollment and the code that confirmed it, which is used up.
+func enableTOTP(t *testing.T, c *testClient) (entity.TOTPEnrollment, string) {
+	resp := c.do(http.MethodPost, "/me/2fa", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var enrollment entity.TOTPEnrollment
+	decode(t, resp, &enrollment)
+	require.NotEmpty(t, enrollment.Secret)
+	require.Len(t, enrollment.RecoveryCodes, 10)
+
+	code := totpCode(t, enrollment.Secret, time.Now())
+	resp = c.do(http.MethodPost, "/me/2fa/confirm", map[string]string{"code": code})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	return enrollment, code
+}
+
+func verify(c *testClient, code string) *http.Response {
+	return c.do(http.MethodPost, "/sessions/2fa", map[string]string{"code": code})
+}
+
+func loginResult(t *testing.T, resp *http.Response) entity.LoginResult {
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var res entity.LoginResult
+	decode(t, resp, &res)
+
+	return res
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	c := a.client()
+	require.False(t, loginResult(t, c.login("nasta", "nasta2023", entity.RolePatient)).MFARequired)
+
+	resp := c.do(http.MethodPost, "/me/2fa", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+
+	var enrollment entity.TOTPEnrollment
+	decode(t, resp, &enrollment)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+
+	// Until it is confirmed, the enrollment does not change how logins work.
+	assert.False(t, loginResult(t, a.client().login("nasta", "nasta2023", entity.RolePatient)).MFARequired)
+
+	resp = c.do(http.MethodPost, "/me/2fa/confirm", map[string]string{"code": "000000"})
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+
+	resp = c.do(http.MethodPost, "/me/2fa/confirm", map[string]string{"code": totpCode(t, enrollment.Secret, time.Now())})
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	assert.True(t, loginResult(t, a.client().login("nasta", "nasta2023", entity.RolePatient)).MFARequired)
+
+	// Enrolling again would silently replace a working authenticator.
+	assert.Equal(t, http.StatusConflict, c.do(http.MethodPost, "/me/2fa", nil).StatusCode)
+}
+
+func TestTOTPPendingSession(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	owner := a.client()
+	owner.login("nasta", "nasta2023", entity.RolePatient)
+	enrollment, _ := enableTOTP(t, owner)
+
+	c := a.client()
+	require.True(t, loginResult(t, c.login("nasta", "nasta2023", entity.RolePatient)).MFARequired)
+	pending := c.cookie("ssid")
+
+	assert.Equal(t, http.StatusUnauthorized, c.do(http.MethodGet, "/me", nil).StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, c.do(http.MethodPost, "/me/2fa", nil).StatusCode)
+
+	resp := verify(c, totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second)))
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, pending, c.cookie("ssid"))
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, "/me", nil).StatusCode)
+
+	// The full session cannot be upgraded again and the pending one is gone.
+	assert.Equal(t, http.StatusUnauthorized, verify(c, "123456").StatusCode)
+
+	req := c.request(http.MethodGet, "/me", nil)
+	req.Header.Set("Cookie", "ssid="+pending)
+	assert.Equal(t, http.StatusUnauthorized, a.client().send(req).StatusCode)
+}
+
+func TestTOTPCodeReplay(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	owner := a.client()
+	owner.login("nasta", "nasta2023", entity.RolePatient)
+	enrollment, used := enableTOTP(t, owner)
+
+	c := a.client()
+	c.login("nasta", "nasta2023", entity.RolePatient)
+	assert.Equal(t, http.StatusUnauthorized, verify(c, used).StatusCode)
+
+	next := totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second))
+	require.Equal(t, http.StatusOK, verify(c, next).StatusCode)
+
+	c = a.client()
+	c.login("nasta", "nasta2023", entity.RolePatient)
+	assert.Equal(t, http.StatusUnauthorized, verify(c, next).StatusCode)
+
+	resp := a.client().do(http.MethodPost, "/sessions", entity.Credentials{
+		Login: "nasta", Password: "nasta2023", Role: entity.RolePatient, OTP: next,
+	})
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestTOTPRecoveryCodes(t *testing.T) {
+	a := newTestAPI(t, testOptions())
+	a.addPatient("nasta", "nasta2023")
+
+	owner := a.client()
+	owner.login("nasta", "nasta2023", entity.RolePatient)
+	enrollment, _ := enableTOTP(t, owner)
+	code := enrollment.RecoveryCodes[0]
+
+	c := a.client()
+	c.login("nasta", "nasta2023", entity.RolePatient)
+	require.Equal(t, http.StatusOK, verify(c, code).StatusCode)
+
+	c = a.client()
+	c.login("nasta", "nasta2023", entity.RolePatient)
+	assert.Equal(t, http.StatusUnauthorized, verify(c, code).StatusCode)
+	assert.Equal(t, http.StatusOK, verify(c, enrollment.RecoveryCodes[1]).StatusCode)
+}
+
+func TestTOTPThrottling(t *testing.T) {
+	opts := testOptions()
+	opts.LoginThrottle.FreeAttempts = 100
+	opts.LoginThrottle.LockoutThreshold = 3
+	a := newTestAPI(t, opts)
+	a.addPatient("nasta", "nasta2023")
+
+	owner := a.client()
+	owner.login("nasta", "nasta2023", entity.RolePatient)
+	enrollment, _ := enableTOTP(t, owner)
+
+	c := a.client()
+	c.login("nasta", "nasta2023", entity.RolePatient)
+	assert.Equal(t, http.StatusUnauthorized, verify(c, "000000").StatusCode)
+	assert.Equal(t, http.StatusUnauthorized, verify(c, "000001").StatusCode)
+
+	// Logging in again with the password must not reset the count while the
+	// second factor is still missing.
+	c = a.client()
+	require.True(t, loginResult(t, c.login("nasta", "nasta2023", entity.RolePatient)).MFARequired)
+	assert.Equal(t, http.StatusUnauthorized, verify(c, "000002").StatusCode)
+
+	resp := verify(c, totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second)))
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+}
+
+func TestTOTPRequiredForDoctors(t *testing.T) {
+	opts := testOptions()
+	opts.TOTP.RequiredForDoctors = true
+	a := newTestAPI(t, opts)
+	a.addDoctor("house", "vicodin42", false)
+	p := a.addPatient("nasta", "nasta2023")
+	card := a.addCard(p.ID)
+
+	c := a.client()
+	require.False(t, loginResult(t, c.login("house", "vicodin42", entity.RoleDoctor)).MFARequired)
+
+	// Patients come with their card, so they are covered as well as cards.
+	paths := []string{"/patients/" + p.PassportNumber, "/patients/" + itoa(p.ID) + "/card", "/cards/" + itoa(card.ID)}
+	for _, path := range paths {
+		assert.Equal(t, http.StatusForbidden, c.do(http.MethodGet, path, nil).StatusCode, path)
+	}
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, "/me", nil).StatusCode)
+
+	enrollment, _ := enableTOTP(t, c)
+	c = a.client()
+	c.login("house", "vicodin42", entity.RoleDoctor)
+	require.Equal(t, http.StatusOK, verify(c, totpCode(t, enrollment.Secret, time.Now().Add(30*time.Second))).StatusCode)
+
+	for _, path := range paths {
+		assert.Equal(t, http.StatusOK, c.do(http.MethodGet, path, nil).StatusCode, path)
+	}
+
+	// Patients do not need 2FA to see their own card.
+	c = a.client()
+	c.login("nasta", "nasta2023", entity.RolePatient)
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, "/patients/"+itoa(p.ID)+"/card", nil).StatusCode)
+}